@@ -0,0 +1,84 @@
+package goredis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The size and alignment of t on a 32 bits platform such as 386, where
+// the 64 bits integers are aligned on 4 bytes only.
+func layout32(t reflect.Type) (size, align uintptr) {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1, 1
+	case reflect.Int16, reflect.Uint16:
+		return 2, 2
+	case reflect.Int64, reflect.Uint64, reflect.Float64, reflect.Complex64:
+		return 8, 4
+	case reflect.Complex128:
+		return 16, 4
+	case reflect.String, reflect.Interface:
+		return 8, 4
+	case reflect.Slice:
+		return 12, 4
+	case reflect.Array:
+		size, align := layout32(t.Elem())
+		return size * uintptr(t.Len()), align
+	case reflect.Struct:
+		align = 1
+		for i := 0; i < t.NumField(); i++ {
+			fieldSize, fieldAlign := layout32(t.Field(i).Type)
+			size = (size+fieldAlign-1)/fieldAlign*fieldAlign + fieldSize
+			if fieldAlign > align {
+				align = fieldAlign
+			}
+		}
+		return (size + align - 1) / align * align, align
+	}
+	// int, pointers, maps, channels and functions
+	return 4, 4
+}
+
+// The offset of the field at path, such as "stats.waits", on a 32 bits
+// platform.
+func offset32(t reflect.Type, path string) uintptr {
+	var offset uintptr
+	for _, name := range strings.Split(path, ".") {
+		var field reflect.StructField
+		for i := 0; i < t.NumField(); i++ {
+			_, align := layout32(t.Field(i).Type)
+			offset = (offset + align - 1) / align * align
+			if t.Field(i).Name == name {
+				field = t.Field(i)
+				break
+			}
+			size, _ := layout32(t.Field(i).Type)
+			offset += size
+		}
+		t = field.Type
+	}
+	return offset
+}
+
+// The 64 bits atomics must be 8 bytes aligned on 32 bits platforms, the
+// first word of an allocated struct being so.
+func TestAtomicAlignment(t *testing.T) {
+	for _, tt := range []struct {
+		value  interface{}
+		fields []string
+	}{
+		{RedisCluster{}, []string{"refreshDelay", "lastRefresh", "failLimit.last", "failLimit.suppressed"}},
+		{Pool{}, []string{"stats.waits", "stats.waitDuration", "stats.timeouts", "stats.dials",
+			"stats.dialErrors", "stats.staleClosed", "stats.pingFailures", "warnLimit.last", "warnLimit.suppressed"}},
+		{PubSub{}, []string{"pingInterval"}},
+		{pubsubConn{}, []string{"received"}},
+	} {
+		typ := reflect.TypeOf(tt.value)
+		for _, field := range tt.fields {
+			if offset := offset32(typ, field); offset%8 != 0 {
+				t.Errorf("%s.%s at offset %d on 32 bits", typ.Name(), field, offset)
+			}
+		}
+	}
+}
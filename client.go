@@ -0,0 +1,44 @@
+package goredis
+
+import "context"
+
+// Client is what the clients of every topology have in common: Pool and
+// RedisHandle for a standalone server, RedisCluster and SentinelHandle.
+// Code written against it runs on any of them, and tests can give it a
+// fake.
+type Client interface {
+	Do(cmd string, args ...interface{}) (interface{}, error)
+	DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error)
+	// Send the commands in one round trip per node.
+	Pipeline(commands Commands) ([]*RedisReply, error)
+	Tx() *Tx
+	Watch(fn func(tx *Tx) error, keys ...string) ([]*RedisReply, error)
+	PubSub() *PubSub
+	Scan(match string, count int, typ string) *ScanIterator
+	// The stats of the pools by node address.
+	NodeStats() map[string]PoolStats
+	Close()
+}
+
+var (
+	_ Client = (*Pool)(nil)
+	_ Client = (*RedisHandle)(nil)
+	_ Client = (*RedisCluster)(nil)
+	_ Client = (*SentinelHandle)(nil)
+)
+
+// Return the stats of the pool by its address, "" for a pool which is not
+// the one of a RedisHandle.
+func (this *Pool) NodeStats() map[string]PoolStats {
+	return map[string]PoolStats{this.addr: this.Stats()}
+}
+
+// Same as Stats.
+func (self *RedisCluster) NodeStats() map[string]PoolStats {
+	return self.Stats()
+}
+
+// Same as Stats.
+func (this *SentinelHandle) NodeStats() map[string]PoolStats {
+	return this.Stats()
+}
@@ -0,0 +1,96 @@
+package goredis
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The same code against every topology.
+func testClient(t *testing.T, c Client) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		if _, err := c.Do("SET", fmt.Sprint("client:", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := redis.Int(c.Do("GET", "client:3")); err != nil || v != 3 {
+		t.Error("GET:", v, err)
+	}
+
+	replies, err := c.Pipeline(Commands{NewCommand("GET", "client:1"), NewCommand("GET", "client:2")})
+	if err != nil || replies[0].Str != "1" || replies[1].Str != "2" {
+		t.Error("pipeline:", replies, err)
+	}
+
+	replies, err = c.Watch(func(tx *Tx) error {
+		n, err := redis.Int(tx.Do("GET", "client:4"))
+		if err != nil {
+			return err
+		}
+		return tx.Send("SET", "client:4", n*10)
+	}, "client:4")
+	if err != nil || len(replies) != 1 {
+		t.Error("watch:", replies, err)
+	}
+	if v, err := redis.Int(c.Do("GET", "client:4")); err != nil || v != 40 {
+		t.Error("GET after the transaction:", v, err)
+	}
+
+	keys := 0
+	it := c.Scan("client:*", 3, "")
+	for it.Next() {
+		keys++
+	}
+	if it.Err() != nil || keys != 10 {
+		t.Error("scan:", keys, it.Err())
+	}
+
+	ps := c.PubSub()
+	defer ps.Close()
+	if err := ps.Subscribe("client"); err != nil {
+		t.Fatal(err)
+	}
+	publishTo(t, c.Do, 1, "PUBLISH", "client", "hello")
+	if msg := nextMessage(t, ps); string(msg.Data) != "hello" {
+		t.Errorf("message: %+v", msg)
+	}
+
+	if stats := c.NodeStats(); len(stats) == 0 {
+		t.Error("no stats")
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	server := newFakeServer(newFakeStore().doConn)
+	defer server.Close()
+	handle := NewRedisHandle(server.addr, 4, 4, false)
+	defer handle.Close()
+	testClient(t, handle)
+	if _, ok := handle.NodeStats()[server.addr]; !ok {
+		t.Error("stats:", handle.NodeStats())
+	}
+}
+
+func TestClientCluster(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	testClient(t, cluster)
+}
+
+func TestClientSentinel(t *testing.T) {
+	rs := newFakeReplicaSet("mymaster", 2)
+	defer rs.Close()
+	handle, err := DialSentinel("mymaster", []string{rs.sentinel.addr}, 4, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	testClient(t, handle)
+	if n := rs.nodes[1].count("SET"); n != 0 {
+		t.Error("SET sent", n, "times to the replica")
+	}
+}
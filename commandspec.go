@@ -0,0 +1,371 @@
+package goredis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// KeywordAll means every argument after the keyword is a key (MIGRATE KEYS).
+	KeywordAll = -1
+	// KeywordHalf means the first half of the arguments after the keyword are
+	// keys and the second half their values (XREAD STREAMS).
+	KeywordHalf = -2
+)
+
+// CommandSpec describes where the keys of a command are found. Positions
+// follow the convention of the COMMAND reply: the command name is position
+// 0 and the first argument position 1.
+type CommandSpec struct {
+	Name string
+
+	// Keys at FirstKey, FirstKey+Step, ... up to LastKey. A negative
+	// LastKey counts from the end, -1 being the last argument.
+	// FirstKey is 0 when the command has no keys at a fixed position.
+	FirstKey int
+	LastKey  int
+	Step     int
+
+	// Position of a numkeys argument, the keys directly follow it.
+	NumKeys int
+
+	// Keys after one of the Keywords, searched from position KeywordFrom.
+	// KeywordKeys is the number of keys after the keyword or one of
+	// KeywordAll and KeywordHalf.
+	Keywords    []string
+	KeywordFrom int
+	KeywordKeys int
+
+	// Specs of subcommands (OBJECT ENCODING, XINFO STREAM ...) by lower
+	// case name. The subcommand is position 1.
+	Subcommands map[string]*CommandSpec
+
+	// The command never writes, so replicas can serve it.
+	ReadOnly bool
+}
+
+var commandSpecs = make(map[string]*CommandSpec)
+
+// Register the spec of a command, replacing the existing one if any. Use
+// it to describe the commands of Redis modules.
+func RegisterCommandSpec(spec *CommandSpec) {
+	commandSpecs[strings.ToLower(spec.Name)] = spec
+}
+
+// Return the spec of the command, resolving subcommands from args. It
+// returns nil for unknown commands.
+func LookupCommandSpec(cmd string, args ...interface{}) *CommandSpec {
+	spec, ok := commandSpecs[strings.ToLower(cmd)]
+	if !ok {
+		return nil
+	}
+	if spec.Subcommands != nil {
+		if len(args) == 0 {
+			return spec
+		}
+		if sub, ok := spec.Subcommands[strings.ToLower(argString(args[0]))]; ok {
+			return sub
+		}
+	}
+	return spec
+}
+
+// Return the indexes into args of the keys of the command.
+func (spec *CommandSpec) KeyIndexes(args []interface{}) []int {
+	var indexes []int
+	if spec.FirstKey > 0 {
+		last := spec.LastKey
+		if last < 0 {
+			last = len(args) + 1 + last
+		}
+		if last > len(args) {
+			last = len(args)
+		}
+		step := spec.Step
+		if step <= 0 {
+			step = 1
+		}
+		for pos := spec.FirstKey; pos <= last; pos += step {
+			indexes = append(indexes, pos-1)
+		}
+	}
+	if spec.NumKeys > 0 && spec.NumKeys <= len(args) {
+		n, err := strconv.Atoi(argString(args[spec.NumKeys-1]))
+		if err == nil {
+			for i := spec.NumKeys; i < spec.NumKeys+n && i < len(args); i++ {
+				indexes = append(indexes, i)
+			}
+		}
+	}
+	if len(spec.Keywords) > 0 {
+		from := spec.KeywordFrom
+		if from <= 0 {
+			from = 1
+		}
+		for i := from - 1; i < len(args); i++ {
+			if !spec.isKeyword(argString(args[i])) {
+				continue
+			}
+			rest := len(args) - i - 1
+			n := spec.KeywordKeys
+			switch n {
+			case KeywordAll:
+				n = rest
+			case KeywordHalf:
+				n = rest / 2
+			}
+			for j := i + 1; j <= i+n && j < len(args); j++ {
+				indexes = append(indexes, j)
+			}
+			if spec.KeywordKeys == KeywordAll || spec.KeywordKeys == KeywordHalf {
+				break
+			}
+			i += n
+		}
+	}
+	return indexes
+}
+
+func (spec *CommandSpec) isKeyword(arg string) bool {
+	for _, keyword := range spec.Keywords {
+		if strings.EqualFold(arg, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return all the keys of the command, in argument order. Keys may be of
+// any type accepted as a command argument. Unknown commands are assumed
+// to take their key as the first argument.
+func KeysForCommand(cmd string, args ...interface{}) []string {
+	spec := LookupCommandSpec(cmd, args...)
+	if spec == nil {
+		if len(args) == 0 {
+			return nil
+		}
+		return []string{argString(args[0])}
+	}
+	indexes := spec.KeyIndexes(args)
+	if len(indexes) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		if spec.Name == "migrate" && i == 2 && argString(args[i]) == "" {
+			// MIGRATE host port "" db timeout ... KEYS key ...
+			continue
+		}
+		keys = append(keys, argString(args[i]))
+	}
+	return keys
+}
+
+// Tell whether the command only reads data. Unknown commands are assumed
+// to write.
+func IsReadOnlyCommand(cmd string, args ...interface{}) bool {
+	spec := LookupCommandSpec(cmd, args...)
+	return spec != nil && spec.ReadOnly
+}
+
+// Convert a command argument the way it is written on the wire.
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func registerCommands(names []string, first, last, step int) {
+	for _, name := range names {
+		RegisterCommandSpec(&CommandSpec{Name: name, FirstKey: first, LastKey: last, Step: step})
+	}
+}
+
+func init() {
+	// commands without keys
+	registerCommands([]string{
+		"acl", "asking", "auth", "bgrewriteaof", "bgsave", "client", "cluster",
+		"command", "config", "dbsize", "debug", "discard", "echo", "exec",
+		"failover", "flushall", "flushdb", "function", "hello", "info", "keys",
+		"lastsave", "latency", "lolwut", "module", "monitor", "multi", "ping",
+		"psubscribe", "psync", "publish", "pubsub", "punsubscribe", "quit",
+		"randomkey", "readonly", "readwrite", "replconf", "replicaof", "reset",
+		"role", "save", "scan", "script", "select", "shutdown", "slaveof",
+		"slowlog", "subscribe", "swapdb", "sync", "time", "unsubscribe",
+		"unwatch", "wait", "waitaof",
+	}, 0, 0, 0)
+
+	// one key as first argument
+	registerCommands([]string{
+		// strings
+		"append", "decr", "decrby", "get", "getdel", "getex", "getrange",
+		"getset", "incr", "incrby", "incrbyfloat", "psetex", "set", "setex",
+		"setnx", "setrange", "strlen", "substr",
+		// generic
+		"dump", "expire", "expireat", "expiretime", "move", "persist",
+		"pexpire", "pexpireat", "pexpiretime", "pttl", "restore",
+		"restore-asking", "sort_ro", "ttl", "type",
+		// hashes
+		"hdel", "hexists", "hexpire", "hexpireat", "hexpiretime", "hget",
+		"hgetall", "hgetdel", "hgetex", "hincrby", "hincrbyfloat", "hkeys",
+		"hlen", "hmget", "hmset", "hpersist", "hpexpire", "hpexpireat",
+		"hpexpiretime", "hpttl", "hrandfield", "hscan", "hset", "hsetex",
+		"hsetnx", "hstrlen", "httl", "hvals",
+		// lists
+		"lindex", "linsert", "llen", "lpop", "lpos", "lpush", "lpushx",
+		"lrange", "lrem", "lset", "ltrim", "rpop", "rpush", "rpushx",
+		// sets
+		"sadd", "scard", "sismember", "smembers", "smismember", "spop",
+		"srandmember", "srem", "sscan",
+		// sorted sets
+		"zadd", "zcard", "zcount", "zincrby", "zlexcount", "zmscore",
+		"zpopmax", "zpopmin", "zrandmember", "zrange", "zrangebylex",
+		"zrangebyscore", "zrank", "zrem", "zremrangebylex",
+		"zremrangebyrank", "zremrangebyscore", "zrevrange",
+		"zrevrangebylex", "zrevrangebyscore", "zrevrank", "zscan", "zscore",
+		// bitmaps and hyperloglog
+		"bitcount", "bitfield", "bitfield_ro", "bitpos", "getbit", "setbit",
+		"pfadd",
+		// geo
+		"geoadd", "geodist", "geohash", "geopos", "georadius_ro",
+		"georadiusbymember_ro", "geosearch",
+		// streams
+		"xack", "xackdel", "xadd", "xautoclaim", "xclaim", "xdel", "xdelex",
+		"xlen", "xpending", "xrange", "xrevrange", "xsetid", "xtrim",
+		// sharded pub/sub
+		"spublish",
+	}, 1, 1, 1)
+
+	// two keys as first arguments
+	registerCommands([]string{
+		"blmove", "brpoplpush", "copy", "geosearchstore", "lcs", "lmove",
+		"rename", "renamenx", "rpoplpush", "smove", "zrangestore",
+	}, 1, 2, 1)
+
+	// every argument is a key
+	registerCommands([]string{
+		"del", "exists", "pfcount", "pfmerge", "sdiff", "sdiffstore",
+		"sinter", "sinterstore", "ssubscribe", "sunion", "sunionstore",
+		"sunsubscribe", "touch", "unlink", "watch",
+	}, 1, -1, 1)
+
+	// every argument but the trailing timeout is a key
+	registerCommands([]string{"blpop", "brpop", "bzpopmax", "bzpopmin"}, 1, -2, 1)
+
+	// alternating keys and values
+	registerCommands([]string{"mset", "msetnx"}, 1, -1, 2)
+	registerCommands([]string{"mget"}, 1, -1, 1)
+
+	// BITOP operation destkey key [key ...]
+	registerCommands([]string{"bitop"}, 2, -1, 1)
+	// PFDEBUG subcommand key
+	registerCommands([]string{"pfdebug"}, 2, 2, 1)
+
+	// numkeys as first argument
+	for _, name := range []string{
+		"lmpop", "sintercard", "zdiff", "zinter", "zintercard", "zmpop", "zunion",
+	} {
+		RegisterCommandSpec(&CommandSpec{Name: name, NumKeys: 1})
+	}
+
+	// numkeys as second argument
+	for _, name := range []string{
+		"blmpop", "bzmpop", "eval", "eval_ro", "evalsha", "evalsha_ro",
+		"fcall", "fcall_ro",
+	} {
+		RegisterCommandSpec(&CommandSpec{Name: name, NumKeys: 2})
+	}
+
+	// destination key followed by numkeys
+	for _, name := range []string{"zdiffstore", "zinterstore", "zunionstore"} {
+		RegisterCommandSpec(&CommandSpec{Name: name, FirstKey: 1, LastKey: 1, Step: 1, NumKeys: 2})
+	}
+
+	// SORT key ... [STORE destination]
+	RegisterCommandSpec(&CommandSpec{
+		Name: "sort", FirstKey: 1, LastKey: 1, Step: 1,
+		Keywords: []string{"store"}, KeywordFrom: 2, KeywordKeys: 1,
+	})
+	// GEORADIUS key longitude latitude radius unit ... [STORE key] [STOREDIST key]
+	RegisterCommandSpec(&CommandSpec{
+		Name: "georadius", FirstKey: 1, LastKey: 1, Step: 1,
+		Keywords: []string{"store", "storedist"}, KeywordFrom: 6, KeywordKeys: 1,
+	})
+	// GEORADIUSBYMEMBER key member radius unit ... [STORE key] [STOREDIST key]
+	RegisterCommandSpec(&CommandSpec{
+		Name: "georadiusbymember", FirstKey: 1, LastKey: 1, Step: 1,
+		Keywords: []string{"store", "storedist"}, KeywordFrom: 5, KeywordKeys: 1,
+	})
+	// XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...] id [id ...]
+	RegisterCommandSpec(&CommandSpec{
+		Name: "xread", Keywords: []string{"streams"}, KeywordKeys: KeywordHalf,
+	})
+	// XREADGROUP GROUP group consumer ... STREAMS key [key ...] id [id ...]
+	RegisterCommandSpec(&CommandSpec{
+		Name: "xreadgroup", Keywords: []string{"streams"}, KeywordFrom: 4, KeywordKeys: KeywordHalf,
+	})
+	// MIGRATE host port key|"" destination-db timeout ... [KEYS key [key ...]]
+	RegisterCommandSpec(&CommandSpec{
+		Name: "migrate", FirstKey: 3, LastKey: 3, Step: 1,
+		Keywords: []string{"keys"}, KeywordFrom: 6, KeywordKeys: KeywordAll,
+	})
+
+	// subcommands taking a key as second argument
+	subcommands := map[string][]string{
+		"object": {"encoding", "freq", "idletime", "refcount"},
+		"memory": {"usage"},
+		"xinfo":  {"consumers", "groups", "stream"},
+		"xgroup": {"create", "createconsumer", "delconsumer", "destroy", "setid"},
+	}
+	for name, subs := range subcommands {
+		spec := &CommandSpec{Name: name, Subcommands: make(map[string]*CommandSpec)}
+		for _, sub := range subs {
+			spec.Subcommands[sub] = &CommandSpec{Name: name + "|" + sub, FirstKey: 2, LastKey: 2, Step: 1}
+		}
+		RegisterCommandSpec(spec)
+	}
+
+	// commands which replicas can serve
+	for _, name := range []string{
+		"bitcount", "bitfield_ro", "bitpos", "dump", "eval_ro", "evalsha_ro",
+		"exists", "expiretime", "fcall_ro", "geodist", "geohash", "geopos",
+		"georadius_ro", "georadiusbymember_ro", "geosearch", "get", "getbit",
+		"getrange", "hexists", "hexpiretime", "hget", "hgetall", "hkeys",
+		"hlen", "hmget", "hpexpiretime", "hpttl", "hrandfield", "hscan",
+		"hstrlen", "httl", "hvals", "lcs", "lindex", "llen", "lpos", "lrange",
+		"mget", "pexpiretime", "pfcount", "pttl", "scard", "sdiff", "sinter",
+		"sintercard", "sismember", "smembers", "smismember", "sort_ro",
+		"srandmember", "sscan", "strlen", "substr", "sunion", "ttl", "type",
+		"xlen", "xpending", "xrange", "xread", "xrevrange", "zcard", "zcount",
+		"zdiff", "zinter", "zintercard", "zlexcount", "zmscore",
+		"zrandmember", "zrange", "zrangebylex", "zrangebyscore", "zrank",
+		"zrevrange", "zrevrangebylex", "zrevrangebyscore", "zrevrank",
+		"zscan", "zscore", "zunion",
+	} {
+		commandSpecs[name].ReadOnly = true
+	}
+	for _, name := range []string{"object", "memory", "xinfo"} {
+		for _, sub := range commandSpecs[name].Subcommands {
+			sub.ReadOnly = true
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package goredis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeysForCommand(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		keys []string
+	}{
+		{"GET", []interface{}{"foo"}, []string{"foo"}},
+		{"get", []interface{}{[]byte("foo")}, []string{"foo"}},
+		{"GET", []interface{}{42}, []string{"42"}},
+		{"GET", []interface{}{int64(-7)}, []string{"-7"}},
+		{"SET", []interface{}{"foo", "bar", "EX", 10}, []string{"foo"}},
+		{"PING", nil, nil},
+		{"INFO", []interface{}{"replication"}, nil},
+		{"MULTI", nil, nil},
+		{"SCAN", []interface{}{0, "MATCH", "*"}, nil},
+		{"MGET", []interface{}{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"MSET", []interface{}{"a", 1, "b", 2}, []string{"a", "b"}},
+		{"DEL", []interface{}{"a", []byte("b")}, []string{"a", "b"}},
+		{"BLPOP", []interface{}{"a", "b", 0}, []string{"a", "b"}},
+		{"RENAME", []interface{}{"a", "b"}, []string{"a", "b"}},
+		{"BITOP", []interface{}{"AND", "dest", "a", "b"}, []string{"dest", "a", "b"}},
+		{"PFDEBUG", []interface{}{"GETREG", "hll"}, []string{"hll"}},
+		{"EVAL", []interface{}{"return 1", 2, "a", "b", "arg"}, []string{"a", "b"}},
+		{"EVALSHA", []interface{}{"abc", 0, "arg"}, nil},
+		{"FCALL", []interface{}{"fn", "1", "a", "arg"}, []string{"a"}},
+		{"ZUNIONSTORE", []interface{}{"dest", 2, "a", "b", "WEIGHTS", 1, 2}, []string{"dest", "a", "b"}},
+		{"ZUNION", []interface{}{2, "a", "b", "WITHSCORES"}, []string{"a", "b"}},
+		{"LMPOP", []interface{}{2, "a", "b", "LEFT"}, []string{"a", "b"}},
+		{"BZMPOP", []interface{}{0, 1, "a", "MIN"}, []string{"a"}},
+		{"XREAD", []interface{}{"COUNT", 2, "STREAMS", "s1", "s2", "0", "0"}, []string{"s1", "s2"}},
+		{"XREADGROUP", []interface{}{"GROUP", "g", "c", "streams", "s1", ">"}, []string{"s1"}},
+		{"OBJECT", []interface{}{"ENCODING", "foo"}, []string{"foo"}},
+		{"OBJECT", []interface{}{"HELP"}, nil},
+		{"MEMORY", []interface{}{"USAGE", "foo", "SAMPLES", 5}, []string{"foo"}},
+		{"MEMORY", []interface{}{"STATS"}, nil},
+		{"XINFO", []interface{}{"STREAM", "s"}, []string{"s"}},
+		{"XGROUP", []interface{}{"CREATE", "s", "g", "$"}, []string{"s"}},
+		{"SORT", []interface{}{"src", "BY", "w_*", "STORE", "dst"}, []string{"src", "dst"}},
+		{"GEORADIUS", []interface{}{"g", 15, 37, 200, "km", "STORE", "d1", "STOREDIST", "d2"}, []string{"g", "d1", "d2"}},
+		{"MIGRATE", []interface{}{"h", 6379, "foo", 0, 5000}, []string{"foo"}},
+		{"MIGRATE", []interface{}{"h", 6379, "", 0, 5000, "REPLACE", "KEYS", "a", "b"}, []string{"a", "b"}},
+		{"MYMODULE.CMD", []interface{}{"foo", "bar"}, []string{"foo"}},
+	}
+	for _, tt := range tests {
+		keys := KeysForCommand(tt.cmd, tt.args...)
+		if !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("KeysForCommand(%s %v)=%q, want %q", tt.cmd, tt.args, keys, tt.keys)
+		}
+	}
+}
+
+func TestRegisterCommandSpec(t *testing.T) {
+	RegisterCommandSpec(&CommandSpec{Name: "TEST.MGET", FirstKey: 2, LastKey: -1, Step: 1})
+	defer delete(commandSpecs, "test.mget")
+	keys := KeysForCommand("test.mget", "opt", "a", "b")
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Fatal(keys)
+	}
+}
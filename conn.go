@@ -1,6 +1,8 @@
 package goredis
 
 import (
+	"context"
+
 	"github.com/garyburd/redigo/redis"
 )
 
@@ -15,11 +17,8 @@ func (this *RedisConn) Close() error {
 	if this.err != nil || this.pool == nil {
 		return nil
 	} else if this.conn != nil {
-		if this.conn.Err() != nil {
-			return this.conn.Close()
-		} else {
-			this.pool.Put(this)
-		}
+		// Put discards the broken connections
+		this.pool.Put(this)
 	}
 
 	return nil
@@ -30,6 +29,49 @@ func (this *RedisConn) Command(commandName string, args ...interface{}) *RedisRe
 	return NewRedisReply(reply, err)
 }
 
+// Send the commands in one pipeline and return their replies in order.
+// The error of a command is in its reply and doesn't affect the others.
+// When the connection fails the remaining replies hold the error, which is
+// also returned, and the pool discards the connection on Close.
+func (this *RedisConn) DoMulti(commands Commands) ([]*RedisReply, error) {
+	if hooks := this.hooks(); len(hooks) > 0 {
+		info := &PipelineInfo{Commands: commands, Addr: this.pool.addr}
+		return hooks.pipeline(context.Background(), info, func(ctx context.Context) ([]*RedisReply, error) {
+			return this.doMulti(commands)
+		})
+	}
+	return this.doMulti(commands)
+}
+
+func (this *RedisConn) doMulti(commands Commands) ([]*RedisReply, error) {
+	replies := make([]*RedisReply, len(commands))
+	fail := func(from int, err error) ([]*RedisReply, error) {
+		for i := from; i < len(replies); i++ {
+			replies[i] = NewRedisReply(nil, err)
+		}
+		return replies, err
+	}
+	if this.err != nil {
+		return fail(0, this.err)
+	}
+	for _, command := range commands {
+		if err := this.conn.Send(command.CommandName, command.Args...); err != nil {
+			return fail(0, err)
+		}
+	}
+	if err := this.conn.Flush(); err != nil {
+		return fail(0, err)
+	}
+	for i := range commands {
+		reply, err := this.conn.Receive()
+		if err != nil && this.conn.Err() != nil {
+			return fail(i, err)
+		}
+		replies[i] = NewRedisReply(reply, err)
+	}
+	return replies, nil
+}
+
 func (this *RedisConn) Conn() redis.Conn {
 	return this.conn
 }
@@ -41,13 +83,66 @@ func (this *RedisConn) Err() error {
 	return this.conn.Err()
 }
 
+// Return the hooks of the pool of the connection.
+func (this *RedisConn) hooks() hookList {
+	if this.err != nil || this.pool == nil {
+		return nil
+	}
+	return loadHooks(&this.pool.hooks)
+}
+
 func (this *RedisConn) Do(commandName string, args ...interface{}) (reply interface{}, err error) {
 	if this.err != nil {
 		return nil, this.err
 	}
+	if hooks := this.hooks(); len(hooks) > 0 {
+		info := &CommandInfo{Name: commandName, Args: args, Addr: this.pool.addr, Slot: -1}
+		return hooks.process(context.Background(), info, func(ctx context.Context) (interface{}, error) {
+			return this.conn.Do(commandName, args...)
+		})
+	}
 	return this.conn.Do(commandName, args...)
 }
 
+// Same as Do, but give up once ctx is done. The connection is closed then,
+// as the reply can't be read anymore, and the pool discards it.
+func (this *RedisConn) DoContext(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	if hooks := this.hooks(); len(hooks) > 0 {
+		info := &CommandInfo{Name: commandName, Args: args, Addr: this.pool.addr, Slot: -1}
+		return hooks.process(ctx, info, func(ctx context.Context) (interface{}, error) {
+			return this.doContext(ctx, commandName, args...)
+		})
+	}
+	return this.doContext(ctx, commandName, args...)
+}
+
+func (this *RedisConn) doContext(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return this.conn.Do(commandName, args...)
+	}
+	closed := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		this.conn.Close()
+		close(closed)
+	})
+	reply, err = this.conn.Do(commandName, args...)
+	if !stop() {
+		// ctx was done meanwhile: wait for the close, the connection must
+		// not be closed once back in the pool
+		<-closed
+		if err != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return reply, err
+}
+
 func (this *RedisConn) Send(commandName string, args ...interface{}) error {
 	if this.err != nil {
 		return this.err
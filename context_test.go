@@ -0,0 +1,120 @@
+package goredis
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolGetContext(t *testing.T) {
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+	pool.Update(1, 1)
+
+	conn := pool.Get()
+	if conn.Err() != nil {
+		t.Fatal(conn.Err())
+	}
+	// the only connection is busy
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := pool.GetContext(ctx).Err(); err != context.DeadlineExceeded {
+		t.Fatal("get:", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("waited", d)
+	}
+	conn.Close()
+	if _, err := pool.DoContext(context.Background(), "SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnDoContext(t *testing.T) {
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := pool.DoContext(ctx, "BLPOP", "list", "5"); err != context.DeadlineExceeded {
+		t.Fatal("do:", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("waited", d)
+	}
+	// the connection was in the middle of a reply, it is not reused
+	if n := atomic.LoadInt32(&pool.curActive); n != 0 {
+		t.Error("curActive:", n)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := pool.DoContext(ctx, "GET", "foo"); err != context.Canceled {
+		t.Error("canceled:", err)
+	}
+}
+
+// The connections are not closed once the commands returned, when their
+// context is canceled right after.
+func TestConnDoContextCancelAfter(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3000; j++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				if _, err := pool.DoContext(ctx, "PING"); err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if failed != 0 {
+		t.Error(failed, "commands failed")
+	}
+	// at most one dial per goroutine, the busy pool may go over its
+	// maximum
+	if stats := pool.Stats(); stats.StaleClosed != 0 || stats.Dials > 8 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+func TestClusterDoContext(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+
+	if _, err := cluster.DoContext(context.Background(), "SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cluster.DoContext(ctx, "BLPOP", "list", "5"); err != context.DeadlineExceeded {
+		t.Fatal("do:", err)
+	}
+	if _, err := cluster.DoContext(ctx, "GET", "foo"); err != context.DeadlineExceeded {
+		t.Error("expired:", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := cluster.DoContext(ctx, "MGET", "foo", "bar"); err != context.Canceled {
+		t.Error("canceled:", err)
+	}
+}
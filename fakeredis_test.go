@@ -0,0 +1,1106 @@
+package goredis
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A status reply, plain strings are sent as bulk strings.
+type fakeStatus string
+
+// Several replies to one command, such as the confirmations of SUBSCRIBE.
+type fakeReplies []interface{}
+
+// fakeServer is a minimal RESP server for the tests. Every command is
+// passed to handler, whose result is written back as the reply.
+type fakeServer struct {
+	ln      net.Listener
+	addr    string
+	handler func(c *fakeConn, args []string) interface{}
+	mutex   sync.Mutex
+	conns   map[*fakeConn]bool
+	counts  map[string]int
+	scripts map[string]string // by SHA1, each node has its own cache
+}
+
+type fakeConn struct {
+	server *fakeServer
+	conn   net.Conn
+	wmutex sync.Mutex // w is shared with the publishers
+	w      *bufio.Writer
+	// per connection state, free for the handlers to use
+	asking   bool
+	readonly bool
+	authed   bool
+	db       int
+	name     string
+	// MULTI state, see fakeStore.doConn
+	multi    bool
+	queued   [][]string
+	queueErr bool
+	watched  map[string]*string
+	closed   int32
+	// subscriptions, guarded by the mutex of the fakeStore
+	channels map[string]bool
+	patterns map[string]bool
+	shards   map[string]bool
+}
+
+func (c *fakeConn) subscribed() bool {
+	return len(c.channels)+len(c.patterns)+len(c.shards) > 0
+}
+
+// Write a reply the client didn't ask for, such as a published message.
+func (c *fakeConn) push(reply interface{}) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	c.write(reply)
+	c.w.Flush()
+}
+
+func newFakeServer(handler func(c *fakeConn, args []string) interface{}) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	return startFakeServer(ln, handler)
+}
+
+func newFakeTLSServer(config *tls.Config, handler func(c *fakeConn, args []string) interface{}) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	return startFakeServer(tls.NewListener(ln, config), handler)
+}
+
+func startFakeServer(ln net.Listener, handler func(c *fakeConn, args []string) interface{}) *fakeServer {
+	s := &fakeServer{
+		ln:      ln,
+		addr:    ln.Addr().String(),
+		handler: handler,
+		conns:   make(map[*fakeConn]bool),
+		counts:  make(map[string]int),
+		scripts: make(map[string]string),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeConn{
+			server: s,
+			conn:   conn,
+			w:      bufio.NewWriter(conn),
+		}
+		s.mutex.Lock()
+		s.conns[c] = true
+		s.mutex.Unlock()
+		go c.serve()
+	}
+}
+
+// Number of times the command was received, name in upper case with the
+// subcommand if any, such as "CLUSTER NODES".
+func (s *fakeServer) count(name string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.counts[name]
+}
+
+// Close the listener and every connection.
+func (s *fakeServer) Close() {
+	s.ln.Close()
+	s.closeConns()
+}
+
+// Close the client connections, keep listening.
+func (s *fakeServer) closeConns() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.conns {
+		c.conn.Close()
+		delete(s.conns, c)
+	}
+}
+
+func (c *fakeConn) serve() {
+	defer atomic.StoreInt32(&c.closed, 1)
+	defer c.conn.Close()
+	r := bufio.NewReader(c.conn)
+	for {
+		args, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		if len(args) > 1 && (name == "CLUSTER" || name == "CLIENT" || name == "SCRIPT" || name == "SENTINEL") {
+			name += " " + strings.ToUpper(args[1])
+		}
+		c.server.mutex.Lock()
+		c.server.counts[name]++
+		c.server.mutex.Unlock()
+		reply := c.server.handler(c, args)
+		if _, isErr := reply.(error); isErr && c.multi && name != "EXEC" && name != "DISCARD" {
+			// a command failed to queue, EXEC will abort
+			c.queueErr = true
+		}
+		c.wmutex.Lock()
+		c.write(reply)
+		err = c.w.Flush()
+		c.wmutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *fakeConn) write(reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		c.w.WriteString("$-1\r\n")
+	case fakeStatus:
+		c.w.WriteString("+" + string(v) + "\r\n")
+	case fakeReplies:
+		for _, e := range v {
+			c.write(e)
+		}
+	case error:
+		c.w.WriteString("-" + v.Error() + "\r\n")
+	case int:
+		c.w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case int64:
+		c.w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case string:
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(v), v)
+	case []byte:
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		if v == nil {
+			c.w.WriteString("*-1\r\n")
+			return
+		}
+		fmt.Fprintf(c.w, "*%d\r\n", len(v))
+		for _, e := range v {
+			c.write(e)
+		}
+	case []string:
+		fmt.Fprintf(c.w, "*%d\r\n", len(v))
+		for _, e := range v {
+			c.write(e)
+		}
+	default:
+		panic(fmt.Sprintf("fake redis: unsupported reply %T", reply))
+	}
+}
+
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		// inline command
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n <= 0 {
+		return nil, errors.New("fake redis: bad array")
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimRight(line, "\r\n")[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// fakeStore is a key space shared by the nodes of a fake cluster, so
+// that moving slots around does not lose data.
+type fakeStore struct {
+	mutex sync.Mutex
+	data  map[string]string
+	// AUTH required when password is set
+	username string
+	password string
+	// the connections in subscribed state
+	subscribers map[*fakeConn]bool
+	// the command run by each function, for FCALL
+	functions map[string]string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		data:        make(map[string]string),
+		subscribers: make(map[*fakeConn]bool),
+		functions:   make(map[string]string),
+	}
+}
+
+// The data commands understood by the fake servers.
+var fakeStoreCommands = map[string]bool{
+	"PING": true, "SET": true, "GET": true, "MSET": true, "MGET": true,
+	"DEL": true, "UNLINK": true, "EXISTS": true, "TOUCH": true, "INCR": true,
+}
+
+func (s *fakeStore) do(args []string) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.doLocked(args)
+}
+
+// Run the command for the connection, with the transactions commands
+// MULTI, EXEC, DISCARD, WATCH and UNWATCH.
+func (s *fakeStore) doConn(c *fakeConn, args []string) interface{} {
+	if reply, done := s.auth(c, args); done {
+		return reply
+	}
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "SELECT":
+		db, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		c.db = db
+		return fakeStatus("OK")
+	case "CLIENT":
+		switch strings.ToUpper(args[1]) {
+		case "SETNAME":
+			c.name = args[2]
+			return fakeStatus("OK")
+		case "GETNAME":
+			return c.name
+		}
+	case "MULTI":
+		if c.multi {
+			return errors.New("ERR MULTI calls can not be nested")
+		}
+		c.multi = true
+		return fakeStatus("OK")
+	case "DISCARD", "EXEC":
+		if !c.multi {
+			return fmt.Errorf("ERR %s without MULTI", name)
+		}
+		queued, queueErr, watched := c.queued, c.queueErr, c.watched
+		c.multi, c.queued, c.queueErr, c.watched = false, nil, false, nil
+		if name == "DISCARD" {
+			return fakeStatus("OK")
+		}
+		if queueErr {
+			return errors.New("EXECABORT Transaction discarded because of previous errors.")
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for key, value := range watched {
+			current, ok := s.data[key]
+			if ok != (value != nil) || (ok && current != *value) {
+				return []interface{}(nil)
+			}
+		}
+		replies := make([]interface{}, len(queued))
+		for i, args := range queued {
+			replies[i] = s.doLocked(args)
+		}
+		return replies
+	case "WATCH":
+		if c.multi {
+			return errors.New("ERR WATCH inside MULTI is not allowed")
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if c.watched == nil {
+			c.watched = make(map[string]*string)
+		}
+		for _, key := range args[1:] {
+			if _, ok := c.watched[key]; ok {
+				continue
+			}
+			var value *string
+			if v, ok := s.data[key]; ok {
+				value = &v
+			}
+			c.watched[key] = value
+		}
+		return fakeStatus("OK")
+	case "UNWATCH":
+		c.watched = nil
+		return fakeStatus("OK")
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE":
+		return s.subscribe(c, args)
+	case "PUBLISH", "SPUBLISH":
+		return s.publish(args)
+	case "PING":
+		if s.isSubscribed(c) {
+			return []interface{}{"pong", ""}
+		}
+	case "SCAN", "DBSIZE", "FLUSHALL":
+		if !c.multi {
+			return s.keyspace(args, nil)
+		}
+	case "SCRIPT", "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		if !c.multi {
+			return s.script(c, args)
+		}
+	case "BLPOP":
+		// nothing is ever pushed, wait for the timeout
+		if !c.multi {
+			timeout, _ := strconv.ParseFloat(args[len(args)-1], 64)
+			time.Sleep(time.Duration(timeout * float64(time.Second)))
+			return []interface{}(nil)
+		}
+	}
+	if c.multi {
+		if !fakeStoreCommands[name] {
+			return fmt.Errorf("ERR unknown command '%s'", args[0])
+		}
+		c.queued = append(c.queued, args)
+		return fakeStatus("QUEUED")
+	}
+	return s.do(args)
+}
+
+// Answer AUTH, and refuse the other commands until the connection is
+// authenticated.
+func (s *fakeStore) auth(c *fakeConn, args []string) (interface{}, bool) {
+	s.mutex.Lock()
+	username, password := s.username, s.password
+	s.mutex.Unlock()
+	if strings.ToUpper(args[0]) == "AUTH" {
+		user := "default"
+		if len(args) > 2 {
+			user = args[1]
+		}
+		if username == "" {
+			username = "default"
+		}
+		if user != username || args[len(args)-1] != password {
+			return errors.New("WRONGPASS invalid username-password pair or user is disabled."), true
+		}
+		c.authed = true
+		return fakeStatus("OK"), true
+	}
+	if password != "" && !c.authed {
+		return errors.New("NOAUTH Authentication required."), true
+	}
+	return nil, false
+}
+
+// Answer SCAN, DBSIZE and FLUSHALL for the keys kept by keep, all if nil.
+// The SCAN cursor is an offset in the sorted keys.
+func (s *fakeStore) keyspace(args []string, keep func(key string) bool) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var keys []string
+	for key := range s.data {
+		if keep == nil || keep(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	switch strings.ToUpper(args[0]) {
+	case "DBSIZE":
+		return len(keys)
+	case "FLUSHALL":
+		for _, key := range keys {
+			delete(s.data, key)
+		}
+		return fakeStatus("OK")
+	}
+	cursor, _ := strconv.Atoi(args[1])
+	match, count, typ := "*", 10, "string"
+	for i := 2; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "COUNT":
+			count, _ = strconv.Atoi(args[i+1])
+		case "TYPE":
+			typ = args[i+1]
+		}
+	}
+	var found []string
+	end := cursor + count
+	if end >= len(keys) {
+		end = len(keys)
+	}
+	if cursor > end {
+		cursor = end
+	}
+	for _, key := range keys[cursor:end] {
+		if ok, _ := path.Match(match, key); ok && typ == "string" {
+			found = append(found, key)
+		}
+	}
+	next := strconv.Itoa(end)
+	if end == len(keys) {
+		next = "0"
+	}
+	return []interface{}{next, found}
+}
+
+// The fake scripts run the command of their redis.call with the keys then
+// the arguments, whatever their source says after it.
+var fakeScriptCall = regexp.MustCompile(`redis\.call\('(\w+)'`)
+
+// Run the scripts and the functions, caching the scripts on the node.
+func (s *fakeStore) script(c *fakeConn, args []string) interface{} {
+	server := c.server
+	name := strings.ToUpper(args[0])
+	var src string
+	switch name {
+	case "SCRIPT":
+		switch strings.ToUpper(args[1]) {
+		case "LOAD":
+			sum := sha1.Sum([]byte(args[2]))
+			sha := hex.EncodeToString(sum[:])
+			server.mutex.Lock()
+			server.scripts[sha] = args[2]
+			server.mutex.Unlock()
+			return sha
+		case "FLUSH":
+			server.mutex.Lock()
+			server.scripts = make(map[string]string)
+			server.mutex.Unlock()
+			return fakeStatus("OK")
+		}
+		return errors.New("ERR unknown subcommand")
+	case "EVAL", "EVAL_RO":
+		src = args[1]
+		sum := sha1.Sum([]byte(src))
+		server.mutex.Lock()
+		server.scripts[hex.EncodeToString(sum[:])] = src
+		server.mutex.Unlock()
+	case "EVALSHA", "EVALSHA_RO":
+		server.mutex.Lock()
+		cached, ok := server.scripts[strings.ToLower(args[1])]
+		server.mutex.Unlock()
+		if !ok {
+			return errors.New("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		src = cached
+	case "FCALL", "FCALL_RO":
+		s.mutex.Lock()
+		command, ok := s.functions[args[1]]
+		s.mutex.Unlock()
+		if !ok {
+			return errors.New("ERR Function not found")
+		}
+		src = "redis.call('" + command + "')"
+	}
+	m := fakeScriptCall.FindStringSubmatch(src)
+	if m == nil {
+		return nil
+	}
+	return s.do(append([]string{m[1]}, args[3:]...))
+}
+
+// Answer the subscription commands with a confirmation per channel.
+func (s *fakeStore) subscribe(c *fakeConn, args []string) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	kind := strings.ToLower(args[0])
+	var set *map[string]bool
+	switch kind {
+	case "subscribe", "unsubscribe":
+		set = &c.channels
+	case "psubscribe", "punsubscribe":
+		set = &c.patterns
+	default:
+		set = &c.shards
+	}
+	if *set == nil {
+		*set = make(map[string]bool)
+	}
+	channels := args[1:]
+	if len(channels) == 0 && strings.HasSuffix(kind, "unsubscribe") {
+		for channel := range *set {
+			channels = append(channels, channel)
+		}
+		if len(channels) == 0 {
+			return []interface{}{kind, nil, 0}
+		}
+	}
+	var replies fakeReplies
+	for _, channel := range channels {
+		if strings.HasSuffix(kind, "unsubscribe") {
+			delete(*set, channel)
+		} else {
+			(*set)[channel] = true
+		}
+		replies = append(replies, []interface{}{kind, channel, len(*set)})
+	}
+	if c.subscribed() {
+		s.subscribers[c] = true
+	} else {
+		delete(s.subscribers, c)
+	}
+	return replies
+}
+
+func (s *fakeStore) isSubscribed(c *fakeConn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return c.subscribed()
+}
+
+// Push the message to the subscribers, return their number.
+func (s *fakeStore) publish(args []string) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	channel, data := args[1], args[2]
+	n := 0
+	for c := range s.subscribers {
+		if atomic.LoadInt32(&c.closed) == 1 {
+			delete(s.subscribers, c)
+			continue
+		}
+		if strings.ToUpper(args[0]) == "SPUBLISH" {
+			if c.shards[channel] {
+				c.push([]interface{}{"smessage", channel, data})
+				n++
+			}
+			continue
+		}
+		if c.channels[channel] {
+			c.push([]interface{}{"message", channel, data})
+			n++
+		}
+		for pattern := range c.patterns {
+			if ok, _ := path.Match(pattern, channel); ok {
+				c.push([]interface{}{"pmessage", pattern, channel, data})
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Unsubscribe the connections of the server from the shard channels
+// matching drop, as a node does when it loses their slot.
+func (s *fakeStore) dropShards(server *fakeServer, drop func(channel string) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.subscribers {
+		if c.server != server {
+			continue
+		}
+		for channel := range c.shards {
+			if drop(channel) {
+				delete(c.shards, channel)
+				c.push([]interface{}{"sunsubscribe", channel, len(c.shards)})
+			}
+		}
+		if !c.subscribed() {
+			delete(s.subscribers, c)
+		}
+	}
+}
+
+func (s *fakeStore) doLocked(args []string) interface{} {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return fakeStatus("PONG")
+	case "SET":
+		s.data[args[1]] = args[2]
+		return fakeStatus("OK")
+	case "GET":
+		if v, ok := s.data[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "MSET":
+		for i := 1; i+1 < len(args); i += 2 {
+			s.data[args[i]] = args[i+1]
+		}
+		return fakeStatus("OK")
+	case "MGET":
+		values := make([]interface{}, len(args)-1)
+		for i, key := range args[1:] {
+			if v, ok := s.data[key]; ok {
+				values[i] = v
+			}
+		}
+		return values
+	case "DEL", "UNLINK":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.data[key]; ok {
+				delete(s.data, key)
+				n++
+			}
+		}
+		return n
+	case "EXISTS", "TOUCH":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.data[key]; ok {
+				n++
+			}
+		}
+		return n
+	case "INCR":
+		n := 0
+		if v, ok := s.data[args[1]]; ok {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil {
+				return errors.New("ERR value is not an integer or out of range")
+			}
+		}
+		n++
+		s.data[args[1]] = strconv.Itoa(n)
+		return n
+	}
+	return fmt.Errorf("ERR unknown command '%s'", args[0])
+}
+
+// fakeCluster runs a set of fake nodes sharing one fakeStore, each node
+// serving the slots assigned to it and redirecting the others.
+type fakeCluster struct {
+	store    *fakeStore
+	nodes    []*fakeServer
+	masterOf []int // -1 for the masters
+	mutex    sync.Mutex
+	owner    [RedisClusterHashSlots]int
+	// slots being migrated to another node, answered with ASK
+	migrating map[int]int
+	// Redis 4+ "host:port@cport" addresses in CLUSTER NODES
+	busPort bool
+	// commands answered with an unknown command error, such as
+	// "CLUSTER SLOTS" to mimic servers without it
+	unsupported map[string]bool
+	// the nodes serve TLS when set
+	tlsConfig *tls.Config
+}
+
+// Answer the commands with an unknown command error.
+func (fc *fakeCluster) disable(names ...string) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	for _, name := range names {
+		fc.unsupported[name] = true
+	}
+}
+
+// Start migrating the slot to node, its owner answers ASK from now on.
+func (fc *fakeCluster) migrate(slot, node int) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.migrating[slot] = node
+}
+
+func (fc *fakeCluster) setBusPort(busPort bool) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.busPort = busPort
+}
+
+// Start n nodes, the slots being split evenly between them.
+func newFakeCluster(n int) *fakeCluster {
+	return newFakeTLSCluster(n, nil)
+}
+
+// Same as newFakeCluster, the nodes serving TLS with config.
+func newFakeTLSCluster(n int, config *tls.Config) *fakeCluster {
+	fc := &fakeCluster{
+		store:       newFakeStore(),
+		migrating:   make(map[int]int),
+		unsupported: make(map[string]bool),
+		tlsConfig:   config,
+	}
+	for i := 0; i < n; i++ {
+		fc.addNode(-1)
+	}
+	for slot := range fc.owner {
+		fc.owner[slot] = slot * n / RedisClusterHashSlots
+	}
+	return fc
+}
+
+func (fc *fakeCluster) addNode(master int) int {
+	id := len(fc.nodes)
+	handler := func(c *fakeConn, args []string) interface{} {
+		return fc.handle(id, c, args)
+	}
+	if fc.tlsConfig != nil {
+		fc.nodes = append(fc.nodes, newFakeTLSServer(fc.tlsConfig, handler))
+	} else {
+		fc.nodes = append(fc.nodes, newFakeServer(handler))
+	}
+	fc.masterOf = append(fc.masterOf, master)
+	return id
+}
+
+// Start a replica of the master, serving reads on READONLY connections.
+// Call it before connecting the client.
+func (fc *fakeCluster) addReplica(master int) int {
+	return fc.addNode(master)
+}
+
+// Return the replicas of the master.
+func (fc *fakeCluster) replicasOf(master int) []int {
+	var replicas []int
+	for i, m := range fc.masterOf {
+		if m == master {
+			replicas = append(replicas, i)
+		}
+	}
+	return replicas
+}
+
+func (fc *fakeCluster) addrs() []string {
+	addrs := make([]string, len(fc.nodes))
+	for i, node := range fc.nodes {
+		addrs[i] = node.addr
+	}
+	return addrs
+}
+
+// Assign the slots [from, to] to the node. The subscribers of their
+// shard channels on the other nodes are unsubscribed.
+func (fc *fakeCluster) move(from, to, node int) {
+	fc.mutex.Lock()
+	for slot := from; slot <= to; slot++ {
+		fc.owner[slot] = node
+	}
+	fc.mutex.Unlock()
+	for i, server := range fc.nodes {
+		if i != node {
+			fc.store.dropShards(server, func(channel string) bool {
+				slot := int(HashSlot(channel))
+				return slot >= from && slot <= to
+			})
+		}
+	}
+}
+
+func (fc *fakeCluster) ownerOf(slot uint16) int {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.owner[slot]
+}
+
+// Number of times the command was received by all the nodes.
+func (fc *fakeCluster) count(name string) int {
+	n := 0
+	for _, node := range fc.nodes {
+		n += node.count(name)
+	}
+	return n
+}
+
+func (fc *fakeCluster) Close() {
+	for _, node := range fc.nodes {
+		node.Close()
+	}
+}
+
+func (fc *fakeCluster) nodeID(i int) string {
+	return fmt.Sprintf("%040d", i+1)
+}
+
+// Slot ranges of every node, as [from, to] pairs.
+func (fc *fakeCluster) ranges() [][][2]int {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	ranges := make([][][2]int, len(fc.nodes))
+	start := 0
+	for slot := 1; slot <= RedisClusterHashSlots; slot++ {
+		if slot == RedisClusterHashSlots || fc.owner[slot] != fc.owner[start] {
+			node := fc.owner[start]
+			ranges[node] = append(ranges[node], [2]int{start, slot - 1})
+			start = slot
+		}
+	}
+	return ranges
+}
+
+func (fc *fakeCluster) clusterNodes(self int) string {
+	fc.mutex.Lock()
+	busPort := fc.busPort
+	fc.mutex.Unlock()
+	var lines []string
+	for i, ranges := range fc.ranges() {
+		addr := fc.nodes[i].addr
+		if busPort {
+			_, port, _ := net.SplitHostPort(addr)
+			p, _ := strconv.Atoi(port)
+			addr = fmt.Sprintf("%s@%d", addr, p+10000)
+		}
+		flags, master := "master", "-"
+		if fc.masterOf[i] >= 0 {
+			flags, master = "slave", fc.nodeID(fc.masterOf[i])
+		}
+		if i == self {
+			flags = "myself," + flags
+		}
+		fields := []string{fc.nodeID(i), addr, flags, master, "0", "0", strconv.Itoa(i + 1), "connected"}
+		for _, r := range ranges {
+			if r[0] == r[1] {
+				fields = append(fields, strconv.Itoa(r[0]))
+			} else {
+				fields = append(fields, fmt.Sprintf("%d-%d", r[0], r[1]))
+			}
+		}
+		lines = append(lines, strings.Join(fields, " "))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (fc *fakeCluster) clusterSlots() []interface{} {
+	var entries []interface{}
+	for i, ranges := range fc.ranges() {
+		host, port, _ := net.SplitHostPort(fc.nodes[i].addr)
+		p, _ := strconv.Atoi(port)
+		for _, r := range ranges {
+			entry := []interface{}{r[0], r[1], []interface{}{host, p, fc.nodeID(i)}}
+			for _, replica := range fc.replicasOf(i) {
+				host, port, _ := net.SplitHostPort(fc.nodes[replica].addr)
+				p, _ := strconv.Atoi(port)
+				entry = append(entry, []interface{}{host, p, fc.nodeID(replica)})
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (fc *fakeCluster) clusterShards() []interface{} {
+	var shards []interface{}
+	node := func(i int, role string) interface{} {
+		host, port, _ := net.SplitHostPort(fc.nodes[i].addr)
+		p, _ := strconv.Atoi(port)
+		return []interface{}{
+			"id", fc.nodeID(i), "port", p, "ip", host, "endpoint", host,
+			"role", role, "replication-offset", 0, "health", "online",
+		}
+	}
+	for i, ranges := range fc.ranges() {
+		if fc.masterOf[i] >= 0 {
+			continue
+		}
+		var slots []interface{}
+		for _, r := range ranges {
+			slots = append(slots, r[0], r[1])
+		}
+		nodes := []interface{}{node(i, "master")}
+		for _, replica := range fc.replicasOf(i) {
+			nodes = append(nodes, node(replica, "replica"))
+		}
+		shards = append(shards, []interface{}{
+			"slots", slots, "nodes", nodes,
+		})
+	}
+	return shards
+}
+
+func (fc *fakeCluster) handle(id int, c *fakeConn, args []string) interface{} {
+	if reply, done := fc.store.auth(c, args); done {
+		return reply
+	}
+	name := strings.ToUpper(args[0])
+	if len(args) > 1 && name == "CLUSTER" {
+		name += " " + strings.ToUpper(args[1])
+	}
+	fc.mutex.Lock()
+	unsupported := fc.unsupported[name]
+	fc.mutex.Unlock()
+	if unsupported {
+		return fmt.Errorf("ERR unknown command '%s'", name)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "CLUSTER":
+		switch strings.ToUpper(args[1]) {
+		case "INFO":
+			return "cluster_state:ok\r\n"
+		case "NODES":
+			return fc.clusterNodes(id)
+		case "SLOTS":
+			return fc.clusterSlots()
+		case "SHARDS":
+			return fc.clusterShards()
+		}
+		return errors.New("ERR unknown subcommand")
+	case "ASKING":
+		c.asking = true
+		return fakeStatus("OK")
+	case "READONLY":
+		c.readonly = true
+		return fakeStatus("OK")
+	case "PING":
+		if !fc.store.isSubscribed(c) {
+			return fakeStatus("PONG")
+		}
+	case "SCAN", "DBSIZE", "FLUSHALL":
+		// the keys of the slots of the node, or of its master
+		node := id
+		if fc.masterOf[id] >= 0 {
+			node = fc.masterOf[id]
+		}
+		return fc.store.keyspace(args, func(key string) bool {
+			return fc.ownerOf(HashSlot(key)) == node
+		})
+	}
+	asking := c.asking
+	c.asking = false
+	keys := KeysForCommand(args[0], stringArgs(args[1:])...)
+	if len(keys) > 0 {
+		slot := HashSlot(keys[0])
+		for _, key := range keys[1:] {
+			if HashSlot(key) != slot {
+				return errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+			}
+		}
+		owner := fc.ownerOf(slot)
+		replica := fc.masterOf[id] == owner && c.readonly && IsReadOnlyCommand(args[0], stringArgs(args[1:])...)
+		if owner != id && !asking && !replica {
+			return fmt.Errorf("MOVED %d %s", slot, fc.nodes[owner].addr)
+		}
+		fc.mutex.Lock()
+		target, migrating := fc.migrating[int(slot)]
+		fc.mutex.Unlock()
+		if migrating && owner == id {
+			return fmt.Errorf("ASK %d %s", slot, fc.nodes[target].addr)
+		}
+	}
+	return fc.store.doConn(c, args)
+}
+
+func stringArgs(args []string) []interface{} {
+	r := make([]interface{}, len(args))
+	for i, arg := range args {
+		r[i] = arg
+	}
+	return r
+}
+
+// fakeReplicaSet runs a master and its replicas sharing one fakeStore, as
+// if the replication were instant, watched by a fake sentinel.
+type fakeReplicaSet struct {
+	store    *fakeStore
+	nodes    []*fakeServer
+	sentinel *fakeServer
+	events   *fakeStore // the pubsub of the sentinel
+	mutex    sync.Mutex
+	name     string
+	master   int // the one the sentinel knows
+	roles    []string
+}
+
+// Start n nodes monitored as name, the first one being the master.
+func newFakeReplicaSet(name string, n int) *fakeReplicaSet {
+	rs := &fakeReplicaSet{store: newFakeStore(), events: newFakeStore(), name: name}
+	for i := 0; i < n; i++ {
+		id := i
+		rs.roles = append(rs.roles, "slave")
+		rs.nodes = append(rs.nodes, newFakeServer(func(c *fakeConn, args []string) interface{} {
+			return rs.handle(id, c, args)
+		}))
+	}
+	rs.roles[0] = "master"
+	rs.sentinel = newFakeServer(rs.handleSentinel)
+	return rs
+}
+
+func (rs *fakeReplicaSet) role(node int) string {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.roles[node]
+}
+
+// Promote the node, silently unless announce is set: the sentinel knows
+// it, but doesn't publish +switch-master.
+func (rs *fakeReplicaSet) failover(node int, announce bool) {
+	rs.mutex.Lock()
+	old := rs.master
+	for i := range rs.roles {
+		rs.roles[i] = "slave"
+	}
+	rs.roles[node] = "master"
+	rs.master = node
+	rs.mutex.Unlock()
+	if announce {
+		oldHost, oldPort, _ := net.SplitHostPort(rs.nodes[old].addr)
+		newHost, newPort, _ := net.SplitHostPort(rs.nodes[node].addr)
+		rs.events.publish([]string{"PUBLISH", "+switch-master",
+			strings.Join([]string{rs.name, oldHost, oldPort, newHost, newPort}, " ")})
+	}
+}
+
+func (rs *fakeReplicaSet) handle(id int, c *fakeConn, args []string) interface{} {
+	role := rs.role(id)
+	switch strings.ToUpper(args[0]) {
+	case "ROLE":
+		return []interface{}{role, 0, []interface{}{}}
+	case "SET", "DEL", "INCR", "MSET":
+		if role != "master" {
+			return errors.New("READONLY You can't write against a read only replica.")
+		}
+	}
+	return rs.store.doConn(c, args)
+}
+
+func (rs *fakeReplicaSet) handleSentinel(c *fakeConn, args []string) interface{} {
+	if strings.ToUpper(args[0]) != "SENTINEL" {
+		return rs.events.doConn(c, args)
+	}
+	if len(args) < 3 || args[2] != rs.name {
+		return []interface{}(nil)
+	}
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	switch strings.ToUpper(args[1]) {
+	case "GET-MASTER-ADDR-BY-NAME":
+		host, port, _ := net.SplitHostPort(rs.nodes[rs.master].addr)
+		return []string{host, port}
+	case "REPLICAS", "SLAVES":
+		replicas := []interface{}{}
+		for i, node := range rs.nodes {
+			if i != rs.master {
+				host, port, _ := net.SplitHostPort(node.addr)
+				replicas = append(replicas, []string{
+					"name", node.addr, "ip", host, "port", port, "flags", "slave"})
+			}
+		}
+		return replicas
+	}
+	return errors.New("ERR unknown sentinel subcommand")
+}
+
+func (rs *fakeReplicaSet) Close() {
+	rs.sentinel.Close()
+	for _, node := range rs.nodes {
+		node.Close()
+	}
+}
@@ -0,0 +1,143 @@
+package goredis
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// A command seen by the hooks. The After hooks get the result.
+type CommandInfo struct {
+	Name      string
+	Args      []interface{}
+	Addr      string // node serving the command, the last one tried on a cluster
+	Slot      int    // -1 outside of a cluster, or for keys in several slots
+	Redirects int    // MOVED and ASK followed
+	Duration  time.Duration
+	Reply     interface{}
+	Err       error
+}
+
+// A pipeline seen by the hooks. On a cluster, each node gets its own.
+type PipelineInfo struct {
+	Commands Commands
+	Addr     string
+	Duration time.Duration
+	Err      error // connection error, the errors of the commands are in their replies
+}
+
+// A new connection seen by the hooks.
+type DialInfo struct {
+	Addr     string
+	Duration time.Duration
+	Err      error
+}
+
+// Hook intercepts the commands, pipelines and dials of a Pool or a
+// RedisCluster. The Before methods may return a derived context, which is
+// given to the After ones. The hooks run in the order they were added,
+// the After methods in reverse order. Embed BaseHook to implement only
+// some of them.
+type Hook interface {
+	BeforeProcess(ctx context.Context, cmd *CommandInfo) context.Context
+	AfterProcess(ctx context.Context, cmd *CommandInfo)
+	BeforePipeline(ctx context.Context, pipeline *PipelineInfo) context.Context
+	AfterPipeline(ctx context.Context, pipeline *PipelineInfo)
+	BeforeDial(ctx context.Context, dial *DialInfo) context.Context
+	AfterDial(ctx context.Context, dial *DialInfo)
+}
+
+// A Hook doing nothing.
+type BaseHook struct{}
+
+func (BaseHook) BeforeProcess(ctx context.Context, cmd *CommandInfo) context.Context { return ctx }
+func (BaseHook) AfterProcess(ctx context.Context, cmd *CommandInfo)                  {}
+func (BaseHook) BeforePipeline(ctx context.Context, pipeline *PipelineInfo) context.Context {
+	return ctx
+}
+func (BaseHook) AfterPipeline(ctx context.Context, pipeline *PipelineInfo)      {}
+func (BaseHook) BeforeDial(ctx context.Context, dial *DialInfo) context.Context { return ctx }
+func (BaseHook) AfterDial(ctx context.Context, dial *DialInfo)                  {}
+
+// Only the dial methods of the hook, for the pools of the nodes of a
+// cluster, whose commands are seen at the cluster level.
+type dialHook struct {
+	BaseHook
+	hook Hook
+}
+
+func (h dialHook) BeforeDial(ctx context.Context, dial *DialInfo) context.Context {
+	return h.hook.BeforeDial(ctx, dial)
+}
+
+func (h dialHook) AfterDial(ctx context.Context, dial *DialInfo) {
+	h.hook.AfterDial(ctx, dial)
+}
+
+// An immutable list of hooks, replaced as a whole by addHook.
+type hookList []Hook
+
+func loadHooks(v *atomic.Value) hookList {
+	if hooks, ok := v.Load().(*hookList); ok {
+		return *hooks
+	}
+	return nil
+}
+
+// Add the hook to the list stored in v, as a *hookList.
+func addHook(v *atomic.Value, hook Hook) {
+	for {
+		old := v.Load()
+		var hooks hookList
+		if old != nil {
+			hooks = append(hooks, *old.(*hookList)...)
+		}
+		hooks = append(hooks, hook)
+		if v.CompareAndSwap(old, &hooks) {
+			return
+		}
+	}
+}
+
+func (hooks hookList) process(ctx context.Context, info *CommandInfo, do func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	for _, hook := range hooks {
+		ctx = hook.BeforeProcess(ctx, info)
+	}
+	start := time.Now()
+	info.Reply, info.Err = do(ctx)
+	info.Duration = time.Since(start)
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i].AfterProcess(ctx, info)
+	}
+	return info.Reply, info.Err
+}
+
+func (hooks hookList) pipeline(ctx context.Context, info *PipelineInfo, do func(ctx context.Context) ([]*RedisReply, error)) ([]*RedisReply, error) {
+	for _, hook := range hooks {
+		ctx = hook.BeforePipeline(ctx, info)
+	}
+	start := time.Now()
+	replies, err := do(ctx)
+	info.Duration = time.Since(start)
+	info.Err = err
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i].AfterPipeline(ctx, info)
+	}
+	return replies, err
+}
+
+func (hooks hookList) dial(ctx context.Context, info *DialInfo, do func(ctx context.Context) (redis.Conn, error)) (redis.Conn, error) {
+	for _, hook := range hooks {
+		ctx = hook.BeforeDial(ctx, info)
+	}
+	start := time.Now()
+	c, err := do(ctx)
+	info.Duration = time.Since(start)
+	info.Err = err
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i].AfterDial(ctx, info)
+	}
+	return c, err
+}
@@ -0,0 +1,205 @@
+package goredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type hookKey struct{}
+
+// Records what it sees, for the tests.
+type testHook struct {
+	mutex     sync.Mutex
+	commands  []CommandInfo
+	pipelines []PipelineInfo
+	dials     []DialInfo
+	order     *[]string
+	name      string
+}
+
+func (h *testHook) BeforeProcess(ctx context.Context, cmd *CommandInfo) context.Context {
+	if h.order != nil {
+		*h.order = append(*h.order, "before "+h.name)
+	}
+	return context.WithValue(ctx, hookKey{}, h.name)
+}
+
+func (h *testHook) AfterProcess(ctx context.Context, cmd *CommandInfo) {
+	if h.order != nil {
+		*h.order = append(*h.order, fmt.Sprint("after ", h.name, " ", ctx.Value(hookKey{})))
+	}
+	h.mutex.Lock()
+	h.commands = append(h.commands, *cmd)
+	h.mutex.Unlock()
+}
+
+func (h *testHook) BeforePipeline(ctx context.Context, pipeline *PipelineInfo) context.Context {
+	return ctx
+}
+
+func (h *testHook) AfterPipeline(ctx context.Context, pipeline *PipelineInfo) {
+	h.mutex.Lock()
+	h.pipelines = append(h.pipelines, *pipeline)
+	h.mutex.Unlock()
+}
+
+func (h *testHook) BeforeDial(ctx context.Context, dial *DialInfo) context.Context {
+	return ctx
+}
+
+func (h *testHook) AfterDial(ctx context.Context, dial *DialInfo) {
+	h.mutex.Lock()
+	h.dials = append(h.dials, *dial)
+	h.mutex.Unlock()
+}
+
+func TestPoolHooks(t *testing.T) {
+	store := newFakeStore()
+	server := newFakeServer(func(c *fakeConn, args []string) interface{} {
+		if args[0] == "FAIL" {
+			return errors.New("ERR failed")
+		}
+		return store.doConn(c, args)
+	})
+	defer server.Close()
+	handle := NewRedisHandle(server.addr, 4, 4, false)
+	defer handle.Close()
+
+	var order []string
+	first := &testHook{name: "first", order: &order}
+	second := &testHook{name: "second", order: &order}
+	handle.AddHook(first)
+	handle.AddHook(second)
+
+	if _, err := handle.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(order) != "[before first before second after second second after first second]" {
+		t.Error("order:", order)
+	}
+	if _, err := handle.Do("FAIL"); err == nil {
+		t.Error("no error")
+	}
+	if len(first.commands) != 2 {
+		t.Fatal("commands:", len(first.commands))
+	}
+	set, fail := first.commands[0], first.commands[1]
+	if set.Name != "SET" || len(set.Args) != 2 || set.Addr != server.addr || set.Slot != -1 ||
+		set.Reply != "OK" || set.Err != nil || set.Duration <= 0 {
+		t.Errorf("SET: %+v", set)
+	}
+	if fail.Name != "FAIL" || fail.Err == nil || fail.Err.Error() != "ERR failed" {
+		t.Errorf("FAIL: %+v", fail)
+	}
+
+	commands := Commands{}.Append(NewCommand("SET", "a", 1)).Append(NewCommand("GET", "a"))
+	if _, err := handle.Pipeline(commands); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.pipelines) != 1 || len(first.pipelines[0].Commands) != 2 || first.pipelines[0].Addr != server.addr {
+		t.Errorf("pipelines: %+v", first.pipelines)
+	}
+	if len(first.dials) != 1 || first.dials[0].Addr != server.addr || first.dials[0].Err != nil {
+		t.Errorf("dials: %+v", first.dials)
+	}
+
+	// a failed dial is seen too
+	server.Close()
+	handle.Close()
+	bad := NewRedisHandle(server.addr, 4, 4, false)
+	defer bad.Close()
+	hook := &testHook{}
+	bad.AddHook(hook)
+	bad.Do("GET", "foo")
+	if len(hook.dials) != 1 || hook.dials[0].Err == nil {
+		t.Errorf("dials: %+v", hook.dials)
+	}
+}
+
+func TestPoolHooksSkipPing(t *testing.T) {
+	server := newFakeServer(newFakeStore().doConn)
+	defer server.Close()
+	handle := NewRedisHandle(server.addr, 4, 4, false)
+	defer handle.Close()
+	hook := &testHook{}
+	handle.AddHook(hook)
+
+	if _, err := handle.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	// the idle connection gets the periodic PING
+	for i := 0; server.count("PING") == 0; i++ {
+		if i > 300 {
+			t.Fatal("no PING")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	if len(hook.commands) != 1 {
+		t.Errorf("commands: %+v", hook.commands)
+	}
+}
+
+func TestClusterHooks(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs()[:1], 8, 8, false)
+	defer cluster.Close()
+	hook := &testHook{}
+	cluster.AddHook(hook)
+
+	slot := HashSlot("foo")
+	from, to := fc.ownerOf(slot), (fc.ownerOf(slot)+1)%3
+	fc.move(int(slot), int(slot), to)
+	if _, err := cluster.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	// the commands are seen once, by the cluster and not the pool of the node
+	if len(hook.commands) != 1 {
+		t.Fatalf("commands: %+v", hook.commands)
+	}
+	cmd := hook.commands[0]
+	if cmd.Name != "SET" || cmd.Slot != int(slot) || cmd.Redirects != 1 ||
+		cmd.Addr != fc.nodes[to].addr || cmd.Err != nil {
+		t.Errorf("command: %+v, moved from %s", cmd, fc.nodes[from].addr)
+	}
+
+	if _, err := cluster.Do("MGET", "a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := hook.commands[len(hook.commands)-1]; cmd.Name != "MGET" || cmd.Slot != -1 {
+		t.Errorf("command: %+v", cmd)
+	}
+
+	var commands Commands
+	for i := 0; i < 30; i++ {
+		commands = commands.Append(NewCommand("SET", fmt.Sprint("key:", i), i))
+	}
+	if _, err := cluster.Pipeline(commands); err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, pipeline := range hook.pipelines {
+		total += len(pipeline.Commands)
+	}
+	if len(hook.pipelines) != 3 || total != 30 {
+		t.Errorf("pipelines: %d, commands: %d", len(hook.pipelines), total)
+	}
+
+	// the other nodes report their dials, the seed was dialed by
+	// NewRedisCluster, before the hook was added
+	dialed := make(map[string]bool)
+	for _, dial := range hook.dials {
+		dialed[dial.Addr] = true
+	}
+	for i, node := range fc.nodes[1:] {
+		if !dialed[node.addr] {
+			t.Error("node", i+1, "dial not seen")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package goredis
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Logger receives the messages of Pool and RedisCluster, with fields given
+// as key-value pairs like log/slog, whose *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// The default logger: the debug messages are printed to stdout when debug
+// is set, as the Debug flags always did, the others go to the log package.
+type stdLogger struct {
+	prefix string
+	debug  bool
+}
+
+func (l stdLogger) Debug(msg string, args ...interface{}) {
+	if l.debug {
+		fmt.Println(l.format("", msg, args))
+	}
+}
+
+func (l stdLogger) Info(msg string, args ...interface{}) {
+	log.Println(l.format("[Info] ", msg, args))
+}
+
+func (l stdLogger) Warn(msg string, args ...interface{}) {
+	log.Println(l.format("[Warn] ", msg, args))
+}
+
+func (l stdLogger) Error(msg string, args ...interface{}) {
+	log.Println(l.format("[Error] ", msg, args))
+}
+
+func (l stdLogger) format(level, msg string, args []interface{}) string {
+	var b bytes.Buffer
+	b.WriteString(level)
+	b.WriteString(l.prefix)
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", args[i])
+		}
+	}
+	return b.String()
+}
+
+// A logger adding fields to every message.
+type fieldsLogger struct {
+	logger Logger
+	fields []interface{}
+}
+
+// Return a logger adding the fields, key-value pairs, to every message.
+func LoggerWith(logger Logger, fields ...interface{}) Logger {
+	if l, ok := logger.(fieldsLogger); ok {
+		return fieldsLogger{l.logger, append(append([]interface{}{}, l.fields...), fields...)}
+	}
+	return fieldsLogger{logger, fields}
+}
+
+func (l fieldsLogger) with(args []interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(l.fields)+len(args)), l.fields...), args...)
+}
+
+func (l fieldsLogger) Debug(msg string, args ...interface{}) {
+	l.logger.Debug(msg, l.with(args)...)
+}
+
+func (l fieldsLogger) Info(msg string, args ...interface{}) {
+	l.logger.Info(msg, l.with(args)...)
+}
+
+func (l fieldsLogger) Warn(msg string, args ...interface{}) {
+	l.logger.Warn(msg, l.with(args)...)
+}
+
+func (l fieldsLogger) Error(msg string, args ...interface{}) {
+	l.logger.Error(msg, l.with(args)...)
+}
+
+// Holds a Logger in an atomic.Value, which needs a consistent type.
+type loggerHolder struct {
+	Logger
+}
+
+// Let one event through per interval, to keep the warnings of the hot
+// paths from flooding the log.
+type rateLimit struct {
+	last       int64 // unix nano of the last event let through
+	suppressed int64 // events dropped since
+}
+
+// Return whether the event goes through, and the number of events dropped
+// since the previous one.
+func (r *rateLimit) allow(interval time.Duration) (bool, int64) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&r.last)
+	if now-last < int64(interval) || !atomic.CompareAndSwapInt64(&r.last, last, now) {
+		atomic.AddInt64(&r.suppressed, 1)
+		return false, 0
+	}
+	return true, atomic.SwapInt64(&r.suppressed, 0)
+}
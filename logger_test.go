@@ -0,0 +1,128 @@
+package goredis
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ Logger = slog.Default()
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// Records the messages, for the tests.
+type testLogger struct {
+	mutex   sync.Mutex
+	entries []logEntry
+}
+
+func (l *testLogger) log(level, msg string, args []interface{}) {
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(args); i += 2 {
+		fields[fmt.Sprint(args[i])] = args[i+1]
+	}
+	l.mutex.Lock()
+	l.entries = append(l.entries, logEntry{level, msg, fields})
+	l.mutex.Unlock()
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) { l.log("debug", msg, args) }
+func (l *testLogger) Info(msg string, args ...interface{})  { l.log("info", msg, args) }
+func (l *testLogger) Warn(msg string, args ...interface{})  { l.log("warn", msg, args) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.log("error", msg, args) }
+
+// Return the entries with the level and message.
+func (l *testLogger) find(level, msg string) []logEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var found []logEntry
+	for _, e := range l.entries {
+		if e.level == level && e.msg == msg {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func TestStdLoggerFormat(t *testing.T) {
+	l := stdLogger{prefix: "[RedisCluster] "}
+	if s := l.format("[Warn] ", "Failed", []interface{}{"node", "127.0.0.1:7000", "slot", 12}); s != "[Warn] [RedisCluster] Failed node=127.0.0.1:7000 slot=12" {
+		t.Error(s)
+	}
+	if s := l.format("", "odd", []interface{}{"alone"}); s != "[RedisCluster] odd alone" {
+		t.Error(s)
+	}
+}
+
+func TestLoggerWith(t *testing.T) {
+	logger := &testLogger{}
+	LoggerWith(LoggerWith(logger, "node", "a"), "readonly", true).Warn("msg", "slot", 1)
+	entries := logger.find("warn", "msg")
+	if len(entries) != 1 || entries[0].fields["node"] != "a" ||
+		entries[0].fields["readonly"] != true || entries[0].fields["slot"] != 1 {
+		t.Errorf("entries: %+v", entries)
+	}
+}
+
+func TestPoolLoggerRateLimit(t *testing.T) {
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+	logger := &testLogger{}
+	pool.SetLogger(logger)
+	pool.Update(1, 1)
+
+	conn := pool.Get()
+	defer conn.Close()
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		pool.GetContext(ctx)
+		cancel()
+	}
+	warnings := logger.find("warn", "0001 : too many active conn")
+	if len(warnings) != 1 || warnings[0].fields["maxActive"] != int32(1) {
+		t.Errorf("warnings: %+v", warnings)
+	}
+}
+
+func TestClusterLogger(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	logger := &testLogger{}
+	cluster.SetLogger(logger)
+
+	slot := HashSlot("foo")
+	from := fc.ownerOf(slot)
+	fc.move(int(slot), int(slot), (from+1)%3)
+	if _, err := cluster.Do("GET", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	redirects := logger.find("debug", "Redirected")
+	if len(redirects) != 1 {
+		t.Fatalf("redirects: %+v", redirects)
+	}
+	fields := redirects[0].fields
+	if fields["command"] != "GET" || fields["slot"] != slot || fields["redirect"] != "MOVED" ||
+		fields["node"] != fc.nodes[from].addr || fields["to"] != fc.nodes[(from+1)%3].addr {
+		t.Errorf("fields: %+v", fields)
+	}
+
+	// the pools of the nodes log with the node
+	for _, rh := range cluster.loadTable().handles {
+		rh.pool.log().Warn("test")
+	}
+	warnings := logger.find("warn", "test")
+	if len(warnings) != 3 || !strings.HasPrefix(fmt.Sprint(warnings[0].fields["node"]), "127.0.0.1:") {
+		t.Errorf("warnings: %+v", warnings)
+	}
+}
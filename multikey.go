@@ -0,0 +1,122 @@
+package goredis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Commands whose keys may span several slots: RedisCluster splits them by
+// slot and merges the replies. MSETNX is left out, it can't be split
+// without losing its atomicity.
+var multiKeyCommands = map[string]bool{
+	"mget":   true,
+	"mset":   true,
+	"del":    true,
+	"exists": true,
+	"unlink": true,
+	"touch":  true,
+}
+
+// The part of a multi-key command for one slot.
+type slotRequest struct {
+	args    []interface{}
+	indexes []int // index of every key among the keys of the command
+	reply   interface{}
+	err     error
+}
+
+// Split the command by slot. It returns nil when all the keys are in the
+// same slot, or when the command is not a multi-key command.
+func splitBySlot(cmd string, args []interface{}) []*slotRequest {
+	if !multiKeyCommands[strings.ToLower(cmd)] {
+		return nil
+	}
+	spec := LookupCommandSpec(cmd, args...)
+	if spec == nil {
+		return nil
+	}
+	step := spec.Step
+	if step <= 0 {
+		step = 1
+	}
+	var (
+		requests []*slotRequest
+		bySlot   = make(map[uint16]*slotRequest)
+	)
+	for n, i := range spec.KeyIndexes(args) {
+		slot := HashSlot(argString(args[i]))
+		request, ok := bySlot[slot]
+		if !ok {
+			request = &slotRequest{}
+			bySlot[slot] = request
+			requests = append(requests, request)
+		}
+		end := i + step
+		if end > len(args) {
+			end = len(args)
+		}
+		request.args = append(request.args, args[i:end]...)
+		request.indexes = append(request.indexes, n)
+	}
+	if len(requests) < 2 {
+		return nil
+	}
+	return requests
+}
+
+// Send every part of a split command in parallel, each following its own
+// redirections, and merge the replies in the order of the keys.
+func (self *RedisCluster) sendMultiKeyCommand(ctx context.Context, cmd string, requests []*slotRequest) (interface{}, error) {
+	var wg sync.WaitGroup
+	for _, request := range requests {
+		wg.Add(1)
+		go func(request *slotRequest) {
+			defer wg.Done()
+			info := &CommandInfo{Name: cmd, Args: request.args, Slot: -1}
+			request.reply, request.err = self.sendClusterCommand(ctx, info)
+		}(request)
+	}
+	wg.Wait()
+
+	for _, request := range requests {
+		if request.err != nil {
+			return nil, request.err
+		}
+	}
+	switch strings.ToLower(cmd) {
+	case "mget":
+		n := 0
+		for _, request := range requests {
+			n += len(request.indexes)
+		}
+		values := make([]interface{}, n)
+		for _, request := range requests {
+			reply, ok := request.reply.([]interface{})
+			if !ok || len(reply) != len(request.indexes) {
+				return nil, errUnexpectedReply(cmd, request.reply)
+			}
+			for i, index := range request.indexes {
+				values[index] = reply[i]
+			}
+		}
+		return values, nil
+	case "mset":
+		return requests[0].reply, nil
+	default:
+		var sum int64
+		for _, request := range requests {
+			n, ok := request.reply.(int64)
+			if !ok {
+				return nil, errUnexpectedReply(cmd, request.reply)
+			}
+			sum += n
+		}
+		return sum, nil
+	}
+}
+
+func errUnexpectedReply(cmd string, reply interface{}) error {
+	return fmt.Errorf("unexpected reply to %s: %v", cmd, reply)
+}
@@ -0,0 +1,85 @@
+package goredis
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSplitBySlot(t *testing.T) {
+	if requests := splitBySlot("MGET", []interface{}{"{a}1", "{a}2"}); requests != nil {
+		t.Error("same slot split")
+	}
+	if requests := splitBySlot("GET", []interface{}{"a"}); requests != nil {
+		t.Error("GET split")
+	}
+	requests := splitBySlot("MSET", []interface{}{"{a}1", 1, "{b}1", 2, "{a}2", 3})
+	if len(requests) != 2 {
+		t.Fatal("requests:", len(requests))
+	}
+	if !reflect.DeepEqual(requests[0].args, []interface{}{"{a}1", 1, "{a}2", 3}) ||
+		!reflect.DeepEqual(requests[0].indexes, []int{0, 2}) {
+		t.Errorf("first: %+v", requests[0])
+	}
+	if !reflect.DeepEqual(requests[1].args, []interface{}{"{b}1", 2}) ||
+		!reflect.DeepEqual(requests[1].indexes, []int{1}) {
+		t.Errorf("second: %+v", requests[1])
+	}
+}
+
+func TestClusterMultiKey(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+
+	var keys, args []interface{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint("key:", i)
+		keys = append(keys, key)
+		args = append(args, key, i)
+	}
+	if rp, err := cluster.Do("MSET", args...); err != nil || rp != "OK" {
+		t.Fatal(rp, err)
+	}
+	nodes := 0
+	for _, node := range fc.nodes {
+		if node.count("MSET") > 0 {
+			nodes++
+		}
+	}
+	if nodes != 3 {
+		t.Error("MSET sent to", nodes, "nodes")
+	}
+
+	// a slot moves after the table was loaded, its part gets MOVED
+	slot := int(HashSlot("key:7"))
+	fc.move(slot, slot, (fc.ownerOf(uint16(slot))+1)%3)
+
+	rp, err := cluster.Do("MGET", append(keys, "missing")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := rp.([]interface{})
+	if len(values) != 21 || values[20] != nil {
+		t.Fatal(values)
+	}
+	for i := 0; i < 20; i++ {
+		if string(values[i].([]byte)) != fmt.Sprint(i) {
+			t.Error(i, values[i])
+		}
+	}
+
+	if n, err := cluster.Do("EXISTS", keys[:10]...); err != nil || n != int64(10) {
+		t.Error("EXISTS", n, err)
+	}
+	if n, err := cluster.Do("TOUCH", keys[:5]...); err != nil || n != int64(5) {
+		t.Error("TOUCH", n, err)
+	}
+	if n, err := cluster.Do("DEL", keys[:10]...); err != nil || n != int64(10) {
+		t.Error("DEL", n, err)
+	}
+	if n, err := cluster.Do("UNLINK", append(keys, "missing")...); err != nil || n != int64(10) {
+		t.Error("UNLINK", n, err)
+	}
+}
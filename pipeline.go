@@ -0,0 +1,181 @@
+package goredis
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// The commands of a pipeline sent to one node.
+type pipelineGroup struct {
+	handle  *RedisHandle
+	indexes []int // index of every command in the pipeline
+}
+
+// Send the commands in pipelines, one per node, and return the replies
+// in the order of the commands. The commands redirected with MOVED or ASK
+// are retried one by one. The returned error is the first connection
+// error, the errors of the commands are in their replies.
+func (self *RedisCluster) Pipeline(commands Commands) ([]*RedisReply, error) {
+	replies := make([]*RedisReply, len(commands))
+	if len(commands) == 0 {
+		return replies, nil
+	}
+	table := self.loadTable()
+	groups := self.groupByNode(table, commands)
+	hooks := loadHooks(&self.hooks)
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		errs  = make([]error, len(commands))
+		ioErr error
+	)
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group *pipelineGroup) {
+			defer wg.Done()
+			var err error
+			if len(hooks) > 0 {
+				info := &PipelineInfo{Commands: make(Commands, 0, len(group.indexes))}
+				if group.handle != nil {
+					info.Addr = group.handle.Addr
+				}
+				for _, i := range group.indexes {
+					info.Commands = append(info.Commands, commands[i])
+				}
+				_, err = hooks.pipeline(context.Background(), info, func(ctx context.Context) ([]*RedisReply, error) {
+					return nil, pipelineGroupDo(group, commands, replies, errs)
+				})
+			} else {
+				err = pipelineGroupDo(group, commands, replies, errs)
+			}
+			if err != nil {
+				mutex.Lock()
+				if ioErr == nil {
+					ioErr = err
+				}
+				mutex.Unlock()
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	for i, command := range commands {
+		kind, addr := parseRedirect(errs[i])
+		if kind == "" {
+			continue
+		}
+		var (
+			reply interface{}
+			err   error
+		)
+		if kind == "ASK" {
+			reply, err = self.askingDo(context.Background(), self.handleForAddr(addr), command.CommandName, command.Args...)
+		} else {
+			if keys := KeysForCommand(command.CommandName, command.Args...); len(keys) > 0 {
+				self.updateSlot(HashSlot(keys[0]), addr)
+			}
+			self.scheduleRefresh(table)
+			info := &CommandInfo{Name: command.CommandName, Args: command.Args, Slot: -1}
+			reply, err = self.sendClusterCommand(context.Background(), info)
+		}
+		replies[i] = NewRedisReply(reply, err)
+	}
+	return replies, ioErr
+}
+
+// Group the commands by the node serving the slot of their first key.
+// The commands without keys go to any node.
+func (self *RedisCluster) groupByNode(table *clusterTable, commands Commands) []*pipelineGroup {
+	var (
+		groups []*pipelineGroup
+		byAddr = make(map[string]*pipelineGroup)
+	)
+	for i, command := range commands {
+		var handle *RedisHandle
+		if table.single {
+			for _, h := range table.handles {
+				handle = h
+			}
+		} else if key := self.KeyForRequest(command.CommandName, command.Args...); key != "" {
+			handle = self.RedisHandleForSlot(HashSlot(key))
+		} else {
+			handle = self.RandomRedisHandle()
+		}
+		addr := ""
+		if handle != nil {
+			addr = handle.Addr
+		}
+		group, ok := byAddr[addr]
+		if !ok {
+			group = &pipelineGroup{handle: handle}
+			byAddr[addr] = group
+			groups = append(groups, group)
+		}
+		group.indexes = append(group.indexes, i)
+	}
+	return groups
+}
+
+// Pipeline the commands of the group on one connection, and store their
+// replies and errors. On a connection error, the commands from the one
+// without a reply get the error.
+func pipelineGroupDo(group *pipelineGroup, commands Commands, replies []*RedisReply, errs []error) error {
+	fail := func(from int, err error) error {
+		for _, i := range group.indexes[from:] {
+			replies[i] = NewRedisReply(nil, err)
+			errs[i] = err
+		}
+		return err
+	}
+	if group.handle == nil {
+		return fail(0, ErrNoHandle)
+	}
+	conn := group.handle.Get()
+	defer conn.Close()
+	for _, i := range group.indexes {
+		if err := conn.Send(commands[i].CommandName, commands[i].Args...); err != nil {
+			return fail(0, err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fail(0, err)
+	}
+	for n, i := range group.indexes {
+		reply, err := conn.Receive()
+		if err != nil && conn.Err() != nil {
+			return fail(n, err)
+		}
+		replies[i] = NewRedisReply(reply, err)
+		errs[i] = err
+	}
+	return nil
+}
+
+// Send the command to the node on a connection in ASKING mode, as asked by
+// an ASK redirection. The flag only lasts for the next command of the
+// connection, so both are pipelined on the same one.
+func (self *RedisCluster) askingDo(ctx context.Context, handle *RedisHandle, cmd string, args ...interface{}) (interface{}, error) {
+	conn := handle.GetContext(ctx)
+	defer conn.Close()
+	if err := conn.Send("ASKING"); err != nil {
+		return nil, err
+	}
+	// Do flushes ASKING with the command and reads both replies, the
+	// error of either being returned
+	return conn.DoContext(ctx, cmd, args...)
+}
+
+// Return "MOVED" or "ASK" and the address of the node when err is a
+// redirection.
+func parseRedirect(err error) (kind, addr string) {
+	if err == nil {
+		return "", ""
+	}
+	errv := strings.Split(err.Error(), " ")
+	if (errv[0] == "MOVED" || errv[0] == "ASK") && len(errv) == 3 {
+		return errv[0], errv[2]
+	}
+	return "", ""
+}
@@ -0,0 +1,98 @@
+package goredis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClusterPipeline(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+
+	var commands Commands
+	for i := 0; i < 30; i++ {
+		commands = commands.Append(NewCommand("SET", fmt.Sprint("key:", i), i))
+	}
+	for i := 0; i < 30; i++ {
+		commands = commands.Append(NewCommand("GET", fmt.Sprint("key:", i)))
+	}
+	commands = commands.Append(NewCommand("GET", "missing"))
+	commands = commands.Append(NewCommand("PING"))
+
+	// one slot moved and one being migrated since the table was loaded
+	moved := int(HashSlot("key:3"))
+	fc.move(moved, moved, (fc.ownerOf(uint16(moved))+1)%3)
+	asked := int(HashSlot("key:5"))
+	fc.migrate(asked, (fc.ownerOf(uint16(asked))+1)%3)
+
+	replies, err := cluster.Pipeline(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != len(commands) {
+		t.Fatal("replies:", len(replies))
+	}
+	for i := 0; i < 30; i++ {
+		if rp := replies[i]; rp.Type != REDIS_REPLY_STATUS || rp.Str != "OK" {
+			t.Errorf("SET %d: %+v", i, rp)
+		}
+		if rp := replies[30+i]; rp.Type != REDIS_REPLY_STRING || rp.Str != fmt.Sprint(i) {
+			t.Errorf("GET %d: %+v", i, rp)
+		}
+	}
+	if replies[60].Type != REDIS_REPLY_NIL {
+		t.Errorf("missing: %+v", replies[60])
+	}
+	if replies[61].Str != "PONG" {
+		t.Errorf("PING: %+v", replies[61])
+	}
+	nodes := 0
+	for _, node := range fc.nodes {
+		if node.count("SET") > 0 {
+			nodes++
+		}
+	}
+	if nodes != 3 {
+		t.Error("pipeline sent to", nodes, "nodes")
+	}
+	if n := fc.count("ASKING"); n != 2 {
+		t.Error("ASKING:", n)
+	}
+
+	if replies, err := cluster.Pipeline(nil); err != nil || len(replies) != 0 {
+		t.Error(replies, err)
+	}
+}
+
+func TestPipelineGroupConnectionError(t *testing.T) {
+	store := newFakeStore()
+	server := newFakeServer(func(c *fakeConn, args []string) interface{} {
+		if args[0] == "QUIT" {
+			c.conn.Close()
+			return nil
+		}
+		return store.doConn(c, args)
+	})
+	defer server.Close()
+	handle := NewRedisHandle(server.addr, 1, 1, false)
+	defer handle.Close()
+
+	commands := Commands{NewCommand("SET", "foo", "bar"), NewCommand("QUIT"), NewCommand("GET", "foo")}
+	replies := make([]*RedisReply, len(commands))
+	errs := make([]error, len(commands))
+	group := &pipelineGroup{handle: handle, indexes: []int{0, 1, 2}}
+	if err := pipelineGroupDo(group, commands, replies, errs); err == nil {
+		t.Fatal("no connection error")
+	}
+	// the reply received before the error is kept
+	if replies[0].Str != "OK" || errs[0] != nil {
+		t.Errorf("SET: %+v %v", replies[0], errs[0])
+	}
+	for _, i := range []int{1, 2} {
+		if replies[i].Type != REDIS_REPLY_ERROR || errs[i] == nil {
+			t.Errorf("%d: %+v %v", i, replies[i], errs[i])
+		}
+	}
+}
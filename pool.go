@@ -1,8 +1,8 @@
 package goredis
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"sync/atomic"
 	"time"
 
@@ -18,8 +18,51 @@ var (
 	}
 )
 
+// A snapshot of the state and counters of a Pool.
+type PoolStats struct {
+	Active       int32         // open connections, the idle ones included
+	Idle         int32         // connections waiting in the pool
+	Waits        int64         // times Get waited for a connection, maxActive being reached
+	WaitDuration time.Duration // total time waited
+	Timeouts     int64         // waits given up, after waitTime or with the context
+	Dials        int64         // connections dialed
+	DialErrors   int64         // dials failed
+	StaleClosed  int64         // connections closed as broken or idle for too long
+	PingFailures int64         // idle connections failing the periodic PING
+}
+
+// Return the sum of the stats, to aggregate several pools.
+func (s PoolStats) Add(o PoolStats) PoolStats {
+	s.Active += o.Active
+	s.Idle += o.Idle
+	s.Waits += o.Waits
+	s.WaitDuration += o.WaitDuration
+	s.Timeouts += o.Timeouts
+	s.Dials += o.Dials
+	s.DialErrors += o.DialErrors
+	s.StaleClosed += o.StaleClosed
+	s.PingFailures += o.PingFailures
+	return s
+}
+
+// The counters of PoolStats, updated atomically.
+type poolCounters struct {
+	waits        int64
+	waitDuration int64
+	timeouts     int64
+	dials        int64
+	dialErrors   int64
+	staleClosed  int64
+	pingFailures int64
+}
+
 type Pool struct {
-	callback    func() (redis.Conn, error)
+	stats       poolCounters // first for the alignment of the 64 bits atomics
+	warnLimit   rateLimit
+	logger      atomic.Value // loggerHolder
+	hooks       atomic.Value // *hookList
+	addr        string       // for the hooks, set by RedisHandle
+	callback    func(ctx context.Context) (redis.Conn, error)
 	elems       chan *RedisConn
 	maxIdle     int32
 	maxActive   int32
@@ -33,6 +76,14 @@ type Pool struct {
 }
 
 func NewPool(callback func() (redis.Conn, error), maxIdle, maxActive int32) *Pool {
+	return NewPoolContext(func(ctx context.Context) (redis.Conn, error) {
+		return callback()
+	}, maxIdle, maxActive)
+}
+
+// Same as NewPool, with a callback dialing within the context given to
+// GetContext.
+func NewPoolContext(callback func(ctx context.Context) (redis.Conn, error), maxIdle, maxActive int32) *Pool {
 	pool := &Pool{
 		callback:  callback,
 		elems:     make(chan *RedisConn, maxActive),
@@ -47,6 +98,30 @@ func NewPool(callback func() (redis.Conn, error), maxIdle, maxActive int32) *Poo
 	return pool
 }
 
+// Set the logger of the pool, the standard log package by default.
+func (this *Pool) SetLogger(logger Logger) {
+	this.logger.Store(loggerHolder{logger})
+}
+
+// Add a hook seeing the commands, pipelines and dials of the pool.
+func (this *Pool) AddHook(hook Hook) {
+	addHook(&this.hooks, hook)
+}
+
+func (this *Pool) dial(ctx context.Context) (redis.Conn, error) {
+	if hooks := loadHooks(&this.hooks); len(hooks) > 0 {
+		return hooks.dial(ctx, &DialInfo{Addr: this.addr}, this.callback)
+	}
+	return this.callback(ctx)
+}
+
+func (this *Pool) log() Logger {
+	if holder, ok := this.logger.Load().(loggerHolder); ok {
+		return holder.Logger
+	}
+	return stdLogger{}
+}
+
 func (this *Pool) SetWaitTime(d int) {
 	this.waitTime = d
 }
@@ -87,6 +162,20 @@ func (this *Pool) Update(maxIdle, maxActive int32) {
 	atomic.StoreInt32(&this.maxActive, maxActive)
 }
 
+func (this *Pool) Stats() PoolStats {
+	return PoolStats{
+		Active:       atomic.LoadInt32(&this.curActive),
+		Idle:         atomic.LoadInt32(&this.elemsSize),
+		Waits:        atomic.LoadInt64(&this.stats.waits),
+		WaitDuration: time.Duration(atomic.LoadInt64(&this.stats.waitDuration)),
+		Timeouts:     atomic.LoadInt64(&this.stats.timeouts),
+		Dials:        atomic.LoadInt64(&this.stats.dials),
+		DialErrors:   atomic.LoadInt64(&this.stats.dialErrors),
+		StaleClosed:  atomic.LoadInt64(&this.stats.staleClosed),
+		PingFailures: atomic.LoadInt64(&this.stats.pingFailures),
+	}
+}
+
 func (this *Pool) TestConn() error {
 	conn := this.Get()
 	defer conn.Close()
@@ -99,17 +188,31 @@ func (this *Pool) Do(commandName string, args ...interface{}) (reply interface{}
 	return c.Do(commandName, args...)
 }
 
+func (this *Pool) DoContext(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	c := this.GetContext(ctx)
+	defer c.Close()
+	return c.DoContext(ctx, commandName, args...)
+}
+
+// Send the commands in one pipeline on a connection of the pool, see
+// RedisConn.DoMulti.
+func (this *Pool) Pipeline(commands Commands) ([]*RedisReply, error) {
+	c := this.Get()
+	defer c.Close()
+	return c.DoMulti(commands)
+}
+
 func (this *Pool) Put(elem *RedisConn) {
 	if atomic.LoadInt32(&this.status) != 0 {
 		elem.pool = nil
-		elem.Close()
+		elem.conn.Close()
 		return
 	}
 
 	if elem.Err() != nil {
 		atomic.AddInt32(&this.curActive, -1)
 		elem.pool = nil
-		elem.Close()
+		elem.conn.Close()
 		return
 	}
 
@@ -119,18 +222,28 @@ func (this *Pool) Put(elem *RedisConn) {
 		break
 	default:
 		elem.pool = nil
-		elem.Close()
+		elem.conn.Close()
 		atomic.AddInt32(&this.curActive, -1)
 	}
 }
 
 func (this *Pool) Get() *RedisConn {
+	return this.GetContext(context.Background())
+}
+
+// Same as Get, but stop waiting for a connection or dialing once ctx is
+// done. The connection returned then holds the error of ctx.
+func (this *Pool) GetContext(ctx context.Context) *RedisConn {
 	var (
 		elem *RedisConn
 	)
+	if err := ctx.Err(); err != nil {
+		return &RedisConn{err: err}
+	}
 	for {
-		elem = this.get()
+		elem = this.get(ctx)
 		if elem.conn != nil && elem.conn.Err() != nil {
+			atomic.AddInt64(&this.stats.staleClosed, 1)
 			atomic.AddInt32(&this.curActive, -1)
 			elem.conn.Close()
 			continue
@@ -141,7 +254,7 @@ func (this *Pool) Get() *RedisConn {
 	return elem
 }
 
-func (this *Pool) get() *RedisConn {
+func (this *Pool) get(ctx context.Context) *RedisConn {
 	if atomic.LoadInt32(&this.status) != 0 {
 		return closedRedisConn
 	}
@@ -155,8 +268,10 @@ func (this *Pool) get() *RedisConn {
 	default:
 		ca := atomic.LoadInt32(&this.curActive)
 		if ca < this.maxActive {
-			c, err := this.callback()
+			atomic.AddInt64(&this.stats.dials, 1)
+			c, err := this.dial(ctx)
 			if err != nil {
+				atomic.AddInt64(&this.stats.dialErrors, 1)
 				conn = &RedisConn{err: err}
 				break
 			}
@@ -167,16 +282,31 @@ func (this *Pool) get() *RedisConn {
 			}
 			atomic.AddInt32(&this.curActive, 1)
 		} else {
-			log.Println("[Warn] 0001 : too many active conn, maxActive=", this.maxActive)
+			if ok, suppressed := this.warnLimit.allow(time.Second); ok {
+				this.log().Warn("0001 : too many active conn", "maxActive", this.maxActive, "suppressed", suppressed)
+			}
+			atomic.AddInt64(&this.stats.waits, 1)
+			start := time.Now()
 			if this.waitTime != 0 {
 				select {
 				case conn = <-this.elems:
 					atomic.AddInt32(&this.elemsSize, -1)
 				case <-time.After(time.Second * time.Duration(this.waitTime)):
 					conn = emptyRedisConn
+				case <-ctx.Done():
+					conn = &RedisConn{err: ctx.Err()}
 				}
 			} else {
-				conn = <-this.elems
+				select {
+				case conn = <-this.elems:
+					atomic.AddInt32(&this.elemsSize, -1)
+				case <-ctx.Done():
+					conn = &RedisConn{err: ctx.Err()}
+				}
+			}
+			atomic.AddInt64(&this.stats.waitDuration, int64(time.Since(start)))
+			if conn.err != nil {
+				atomic.AddInt64(&this.stats.timeouts, 1)
 			}
 		}
 
@@ -191,7 +321,7 @@ func (this *Pool) Close() {
 		select {
 		case e := <-this.elems:
 			e.pool = nil
-			e.Close()
+			e.conn.Close()
 		default:
 			return
 		}
@@ -213,7 +343,8 @@ func (this *Pool) timerEvent() {
 						atomic.AddInt32(&this.curActive, -1)
 						atomic.AddInt32(&this.elemsSize, -1)
 						e.pool = nil
-						e.Close()
+						e.conn.Close()
+						atomic.AddInt64(&this.stats.staleClosed, 1)
 					default:
 						this.timerStatus = 0
 					}
@@ -222,12 +353,16 @@ func (this *Pool) timerEvent() {
 				}
 			}
 			flag := true
-			n := int(this.elemsSize/this.pingTime + 1)
+			n := int(atomic.LoadInt32(&this.elemsSize)/this.pingTime + 1)
 			for i := 0; (i < n) && flag; i++ {
 				select {
 				case e := <-this.elems:
 					atomic.AddInt32(&this.elemsSize, -1)
-					e.Do("PING")
+					// on the raw connection, the hooks only see the
+					// commands of the users
+					if _, err := e.conn.Do("PING"); err != nil {
+						atomic.AddInt64(&this.stats.pingFailures, 1)
+					}
 					e.Close()
 				default:
 					flag = false
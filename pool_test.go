@@ -1,7 +1,10 @@
 package goredis
 
 import (
+	"context"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -181,6 +184,108 @@ func TestPoolSend(t *testing.T) {
 	}
 }
 
+func TestPoolPipeline(t *testing.T) {
+	store := newFakeStore()
+	server := newFakeServer(func(c *fakeConn, args []string) interface{} {
+		if strings.ToUpper(args[0]) == "CRASH" {
+			c.conn.Close()
+			return nil
+		}
+		return store.doConn(c, args)
+	})
+	defer server.Close()
+	pool := NewPool(func() (redis.Conn, error) {
+		return redis.Dial("tcp", server.addr)
+	}, 4, 4)
+	defer pool.Close()
+
+	var commands Commands
+	commands = commands.Append(NewCommand("SET", "foo", "bar"))
+	commands = commands.Append(NewCommand("NOSUCHCOMMAND"))
+	commands = commands.Append(NewCommand("GET", "foo"))
+	commands = commands.Append(NewCommand("INCR", "n"))
+	replies, err := pool.Pipeline(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies[0].Type != REDIS_REPLY_STATUS || replies[0].Str != "OK" {
+		t.Errorf("SET: %+v", replies[0])
+	}
+	if replies[1].Type != REDIS_REPLY_ERROR {
+		t.Errorf("NOSUCHCOMMAND: %+v", replies[1])
+	}
+	if replies[2].Type != REDIS_REPLY_STRING || replies[2].Str != "bar" {
+		t.Errorf("GET: %+v", replies[2])
+	}
+	if replies[3].Type != REDIS_REPLY_INTEGER || replies[3].Integer != 1 {
+		t.Errorf("INCR: %+v", replies[3])
+	}
+	if n := atomic.LoadInt32(&pool.curActive); n != 1 {
+		t.Error("curActive:", n)
+	}
+
+	// the connection breaks in the middle of the batch
+	commands = Commands{NewCommand("GET", "foo"), NewCommand("CRASH"), NewCommand("GET", "foo")}
+	replies, err = pool.Pipeline(commands)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if replies[0].Str != "bar" || replies[1].Type != REDIS_REPLY_ERROR || replies[2].Type != REDIS_REPLY_ERROR {
+		t.Errorf("replies: %+v %+v %+v", replies[0], replies[1], replies[2])
+	}
+	if n := atomic.LoadInt32(&pool.curActive); n != 0 {
+		t.Error("broken connection kept, curActive:", n)
+	}
+	if replies, err := pool.Pipeline(Commands{NewCommand("GET", "foo")}); err != nil || replies[0].Str != "bar" {
+		t.Error(replies, err)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+	pool.Update(1, 1)
+
+	conn := pool.Get()
+	// the wait is measured from within GetContext, after the deadline
+	// is set, so it is bounded by the elapsed time only
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := pool.GetContext(ctx).Err(); err == nil {
+		t.Fatal("no timeout")
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	stats := pool.Stats()
+	if stats.Active != 1 || stats.Idle != 1 || stats.Dials != 1 || stats.Waits != 1 ||
+		stats.Timeouts != 1 || stats.WaitDuration <= 0 || stats.WaitDuration > elapsed {
+		t.Errorf("stats: %+v", stats)
+	}
+
+	// the idle connection breaks, the periodic PING finds it
+	server.closeConns()
+	for i := 0; pool.Stats().PingFailures == 0; i++ {
+		if i > 300 {
+			t.Fatal("ping failure not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := pool.Stats(); stats.Active != 0 || stats.Idle != 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+
+	bad := NewPool(func() (redis.Conn, error) {
+		return redis.Dial("tcp", "127.0.0.1:1")
+	}, 1, 1)
+	defer bad.Close()
+	bad.Do("PING")
+	if stats := bad.Stats(); stats.Dials != 1 || stats.DialErrors != 1 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
 func BenchmarkPoolDo(b *testing.B) {
 	_testPool.Update(100, 10000)
 	key := "testbenchmark"
@@ -0,0 +1,709 @@
+package goredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Default interval of the PING health checks of PubSub.
+const PubSubPingInterval = 30 * time.Second
+
+const (
+	pubsubBuffer   = 100
+	pubsubRetryMin = 100 * time.Millisecond
+	pubsubRetryMax = 5 * time.Second
+)
+
+var ErrPubSubClosed = errors.New("pubsub closed")
+
+// A message published on a channel.
+type Message struct {
+	Kind    string // "message", "pmessage" for a pattern or "smessage" for a shard channel
+	Channel string
+	Pattern string // the pattern matched, for pmessage
+	Data    []byte
+}
+
+// PubSub receives the messages of its subscriptions on connections of its
+// own, which never go back to a pool. It is safe for concurrent use.
+//
+// The connections are checked with PING, and dialed again when they fail,
+// with the subscriptions. On a cluster, the channels and the patterns live
+// on a connection to any node, the shard channels of SSUBSCRIBE on a
+// connection to the node serving their slot, and follow it when it moves.
+type PubSub struct {
+	// the connection of the shard channel, "" for the channels and the
+	// patterns
+	route   func(channel string) string
+	dial    func(ctx context.Context, key string) (addr string, conn redis.Conn, err error)
+	refresh func() // reload the cluster topology
+	log     func() Logger
+	// called once the subscriptions of a lost connection are sent again,
+	// nil if unused
+	restored func()
+
+	mutex    sync.Mutex
+	channels map[string]bool // the subscriptions asked for
+	patterns map[string]bool
+	shards   map[string]bool
+	conns    map[string]*pubsubConn
+	closed   bool
+
+	pingInterval int64 // time.Duration
+	pingReset    chan struct{}
+	messages     chan *Message
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// A connection of a PubSub, and the subscriptions sent on it. Guarded by
+// the mutex of the PubSub, but received and delivering.
+type pubsubConn struct {
+	key        string
+	addr       string
+	conn       redis.Conn
+	channels   map[string]bool
+	patterns   map[string]bool
+	shards     map[string]bool
+	waiters    []*pubsubWaiter
+	pinged     int64 // unix nano of the last PING
+	received   int64 // unix nano of the last reply
+	delivering int32 // blocked on the messages channel
+}
+
+// A command waiting for the confirmation of each of its channels.
+type pubsubWaiter struct {
+	kind     string
+	channels []string
+	left     int
+	done     chan error // nil when nobody waits
+}
+
+func newPubSub(route func(string) string, dial func(context.Context, string) (string, redis.Conn, error), refresh func(), log func() Logger) *PubSub {
+	this := &PubSub{
+		route:        route,
+		dial:         dial,
+		refresh:      refresh,
+		log:          log,
+		channels:     make(map[string]bool),
+		patterns:     make(map[string]bool),
+		shards:       make(map[string]bool),
+		conns:        make(map[string]*pubsubConn),
+		pingInterval: int64(PubSubPingInterval),
+		pingReset:    make(chan struct{}, 1),
+		messages:     make(chan *Message, pubsubBuffer),
+		done:         make(chan struct{}),
+	}
+	this.wg.Add(1)
+	go this.ping()
+	return this
+}
+
+// Return a PubSub dialing the connections of the pool.
+func (this *Pool) PubSub() *PubSub {
+	return newPubSub(
+		func(channel string) string { return "" },
+		func(ctx context.Context, key string) (string, redis.Conn, error) {
+			// the logger of the pool has the node already
+			conn, err := this.dial(ctx)
+			return "", conn, err
+		},
+		func() {},
+		this.log)
+}
+
+// Return a PubSub on the cluster, routing the shard channels by slot.
+func (self *RedisCluster) PubSub() *PubSub {
+	return newPubSub(self.pubsubRoute, self.pubsubDial, func() {
+		self.refreshTable(self.loadTable())
+	}, self.log)
+}
+
+func (self *RedisCluster) pubsubRoute(channel string) string {
+	if self.loadTable().single {
+		return ""
+	}
+	if handle := self.RedisHandleForSlot(HashSlot(channel)); handle != nil {
+		return handle.Addr
+	}
+	return ""
+}
+
+func (self *RedisCluster) pubsubDial(ctx context.Context, key string) (string, redis.Conn, error) {
+	if self.err != nil {
+		return "", nil, self.err
+	}
+	var handle *RedisHandle
+	if key == "" {
+		handle = self.RandomRedisHandle()
+	} else {
+		handle = self.handleForAddr(key)
+	}
+	if handle == nil {
+		return "", nil, ErrNoHandle
+	}
+	conn, err := handle.pool.dial(ctx)
+	return handle.Addr, conn, err
+}
+
+// The messages of the subscriptions, closed by Close. Keep reading it:
+// once its buffer is full, the connections stop reading too.
+func (this *PubSub) Messages() <-chan *Message {
+	return this.messages
+}
+
+// Set the interval of the health checks. A connection which didn't answer
+// a PING by the next one is closed and dialed again.
+func (this *PubSub) SetPingInterval(d time.Duration) {
+	atomic.StoreInt64(&this.pingInterval, int64(d))
+	select {
+	case this.pingReset <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe to the channels, and return once the server confirmed them.
+// After an error the subscriptions are still restored with the
+// connection, unless Unsubscribe is called.
+func (this *PubSub) Subscribe(channels ...string) error {
+	return this.subscribe("subscribe", channels)
+}
+
+// Subscribe to the channels matching the glob-style patterns.
+func (this *PubSub) PSubscribe(patterns ...string) error {
+	return this.subscribe("psubscribe", patterns)
+}
+
+// Subscribe to the shard channels, on the nodes serving their slots.
+func (this *PubSub) SSubscribe(channels ...string) error {
+	for _, group := range groupBySlot(channels) {
+		if err := this.ssubscribe(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unsubscribe from the channels, from all of them if none is given, and
+// return once the server confirmed.
+func (this *PubSub) Unsubscribe(channels ...string) error {
+	return this.unsubscribe("unsubscribe", channels)
+}
+
+func (this *PubSub) PUnsubscribe(patterns ...string) error {
+	return this.unsubscribe("punsubscribe", patterns)
+}
+
+func (this *PubSub) SUnsubscribe(channels ...string) error {
+	this.mutex.Lock()
+	if len(channels) == 0 {
+		for channel := range this.shards {
+			channels = append(channels, channel)
+		}
+	}
+	for _, channel := range channels {
+		delete(this.shards, channel)
+	}
+	var (
+		err   error
+		dones []chan error
+	)
+	for _, c := range this.conns {
+		var held []string
+		for _, channel := range channels {
+			if c.shards[channel] {
+				delete(c.shards, channel)
+				held = append(held, channel)
+			}
+		}
+		for _, group := range groupBySlot(held) {
+			done, e := this.send(c, "sunsubscribe", group, true)
+			if e != nil {
+				err = e
+				break
+			}
+			dones = append(dones, done)
+		}
+	}
+	this.mutex.Unlock()
+	for _, done := range dones {
+		if e := this.wait(done); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close the connections, and the messages channel once every message
+// received was delivered or dropped.
+func (this *PubSub) Close() error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.closed = true
+	close(this.done)
+	for _, c := range this.conns {
+		c.conn.Close()
+	}
+	this.mutex.Unlock()
+	this.wg.Wait()
+	close(this.messages)
+	return nil
+}
+
+func (this *PubSub) subscribe(kind string, channels []string) error {
+	if len(channels) == 0 {
+		return nil
+	}
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return ErrPubSubClosed
+	}
+	c, err := this.conn("")
+	if err != nil {
+		this.mutex.Unlock()
+		return err
+	}
+	wanted, held := this.channels, c.channels
+	if kind == "psubscribe" {
+		wanted, held = this.patterns, c.patterns
+	}
+	for _, channel := range channels {
+		wanted[channel] = true
+		held[channel] = true
+	}
+	done, err := this.send(c, kind, channels, true)
+	this.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return this.wait(done)
+}
+
+// Subscribe to shard channels of one slot, following the MOVED replies.
+func (this *PubSub) ssubscribe(channels []string) error {
+	for i := 0; ; i++ {
+		this.mutex.Lock()
+		if this.closed {
+			this.mutex.Unlock()
+			return ErrPubSubClosed
+		}
+		for _, channel := range channels {
+			this.shards[channel] = true
+		}
+		c, err := this.conn(this.route(channels[0]))
+		if err != nil {
+			this.mutex.Unlock()
+			return err
+		}
+		for _, channel := range channels {
+			c.shards[channel] = true
+		}
+		done, err := this.send(c, "ssubscribe", channels, true)
+		this.mutex.Unlock()
+		if err == nil {
+			err = this.wait(done)
+		}
+		if !isMoved(err) {
+			return err
+		}
+		if i >= RedisClusterRequestTTL {
+			return fmt.Errorf("%w: %v", ErrTooManyRedirects, err)
+		}
+		this.refresh()
+	}
+}
+
+func (this *PubSub) unsubscribe(kind string, channels []string) error {
+	this.mutex.Lock()
+	wanted := this.channels
+	if kind == "punsubscribe" {
+		wanted = this.patterns
+	}
+	if len(channels) == 0 {
+		for channel := range wanted {
+			channels = append(channels, channel)
+		}
+	}
+	for _, channel := range channels {
+		delete(wanted, channel)
+	}
+	c, ok := this.conns[""]
+	if !ok || len(channels) == 0 {
+		this.mutex.Unlock()
+		return nil
+	}
+	held := c.channels
+	if kind == "punsubscribe" {
+		held = c.patterns
+	}
+	for _, channel := range channels {
+		delete(held, channel)
+	}
+	done, err := this.send(c, kind, channels, true)
+	this.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return this.wait(done)
+}
+
+func (this *PubSub) wait(done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-this.done:
+		return ErrPubSubClosed
+	}
+}
+
+// Return the connection for the key, dialing it if needed. Called with
+// the mutex held.
+func (this *PubSub) conn(key string) (*pubsubConn, error) {
+	if c, ok := this.conns[key]; ok {
+		return c, nil
+	}
+	addr, conn, err := this.dial(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	c := &pubsubConn{
+		key:      key,
+		addr:     addr,
+		conn:     conn,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		shards:   make(map[string]bool),
+		received: time.Now().UnixNano(),
+	}
+	this.conns[key] = c
+	this.wg.Add(1)
+	go this.receive(c)
+	return c, nil
+}
+
+// Send the command, and queue a waiter for its confirmations, whose done
+// channel is returned when wait is set. Called with the mutex held.
+func (this *PubSub) send(c *pubsubConn, kind string, channels []string, wait bool) (chan error, error) {
+	args := make([]interface{}, len(channels))
+	for i, channel := range channels {
+		args[i] = channel
+	}
+	err := c.conn.Send(strings.ToUpper(kind), args...)
+	if err == nil {
+		err = c.conn.Flush()
+	}
+	if err != nil {
+		// the receiver dials again
+		c.conn.Close()
+		return nil, err
+	}
+	w := &pubsubWaiter{kind: kind, channels: channels, left: len(channels)}
+	if wait {
+		w.done = make(chan error, 1)
+	}
+	c.waiters = append(c.waiters, w)
+	return w.done, nil
+}
+
+// Read the replies of the connection until it fails.
+func (this *PubSub) receive(c *pubsubConn) {
+	defer this.wg.Done()
+	for {
+		reply, err := c.conn.Receive()
+		atomic.StoreInt64(&c.received, time.Now().UnixNano())
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				this.reconnect(c, err)
+				return
+			}
+			this.failed(c, err)
+			continue
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) < 2 {
+			continue
+		}
+		kind, _ := redis.String(values[0], nil)
+		switch kind {
+		case "message", "smessage":
+			if len(values) == 3 {
+				channel, _ := redis.String(values[1], nil)
+				data, _ := redis.Bytes(values[2], nil)
+				this.deliver(c, &Message{Kind: kind, Channel: channel, Data: data})
+			}
+		case "pmessage":
+			if len(values) == 4 {
+				pattern, _ := redis.String(values[1], nil)
+				channel, _ := redis.String(values[2], nil)
+				data, _ := redis.Bytes(values[3], nil)
+				this.deliver(c, &Message{Kind: kind, Channel: channel, Pattern: pattern, Data: data})
+			}
+		case "subscribe", "psubscribe", "ssubscribe", "unsubscribe", "punsubscribe", "sunsubscribe":
+			channel, _ := redis.String(values[1], nil)
+			this.confirm(c, kind, channel)
+		}
+	}
+}
+
+func (this *PubSub) deliver(c *pubsubConn, msg *Message) {
+	atomic.StoreInt32(&c.delivering, 1)
+	defer atomic.StoreInt32(&c.delivering, 0)
+	select {
+	case this.messages <- msg:
+	case <-this.done:
+	}
+}
+
+func (this *PubSub) confirm(c *pubsubConn, kind, channel string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if kind == "sunsubscribe" && c.shards[channel] {
+		// not asked for, the slot moved to another node
+		delete(c.shards, channel)
+		this.connLog(c).Debug("Shard channel moved", "channel", channel)
+		this.restoreLater()
+		return
+	}
+	if len(c.waiters) == 0 || c.waiters[0].kind != kind {
+		return
+	}
+	w := c.waiters[0]
+	if w.left--; w.left <= 0 {
+		c.waiters = c.waiters[1:]
+		if w.done != nil {
+			w.done <- nil
+		}
+	}
+}
+
+// An error answered the command of the first waiter.
+func (this *PubSub) failed(c *pubsubConn, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if len(c.waiters) == 0 {
+		this.connLog(c).Warn("PubSub error", "error", err)
+		return
+	}
+	w := c.waiters[0]
+	c.waiters = c.waiters[1:]
+	if w.kind == "ssubscribe" && isMoved(err) {
+		for _, channel := range w.channels {
+			delete(c.shards, channel)
+		}
+		if w.done == nil {
+			this.restoreLater()
+		}
+	}
+	if w.done != nil {
+		w.done <- err
+	} else if !isMoved(err) {
+		this.connLog(c).Warn("PubSub error", "command", w.kind, "error", err)
+	}
+}
+
+// The connection failed, dial again and restore its subscriptions.
+func (this *PubSub) reconnect(c *pubsubConn, err error) {
+	this.mutex.Lock()
+	if this.conns[c.key] == c {
+		delete(this.conns, c.key)
+	}
+	waiters := c.waiters
+	c.waiters = nil
+	closed, shards := this.closed, len(c.shards) > 0
+	this.mutex.Unlock()
+	c.conn.Close()
+	for _, w := range waiters {
+		if w.done != nil {
+			w.done <- err
+		}
+	}
+	if closed {
+		return
+	}
+	this.connLog(c).Warn("PubSub connection lost", "error", err)
+	this.restore(shards)
+}
+
+// Restore in the background. Called with the mutex held.
+func (this *PubSub) restoreLater() {
+	if this.closed {
+		return
+	}
+	this.wg.Add(1)
+	go func() {
+		defer this.wg.Done()
+		this.restore(true)
+	}()
+}
+
+// Subscribe again until it works, refreshing the topology first when
+// shard channels moved.
+func (this *PubSub) restore(refresh bool) {
+	delay := pubsubRetryMin
+	for {
+		if refresh {
+			this.refresh()
+		}
+		err := this.resubscribe()
+		if err == nil {
+			if this.restored != nil {
+				this.restored()
+			}
+			return
+		}
+		this.log().Warn("PubSub resubscribe failed", "error", err, "retry", delay)
+		select {
+		case <-this.done:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > pubsubRetryMax {
+			delay = pubsubRetryMax
+		}
+		refresh = true
+	}
+}
+
+// Send again the subscriptions held by no connection.
+func (this *PubSub) resubscribe() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return nil
+	}
+	var held *pubsubConn
+	if c, ok := this.conns[""]; ok {
+		held = c
+	}
+	var channels, patterns []string
+	for channel := range this.channels {
+		if held == nil || !held.channels[channel] {
+			channels = append(channels, channel)
+		}
+	}
+	for pattern := range this.patterns {
+		if held == nil || !held.patterns[pattern] {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(channels)+len(patterns) > 0 {
+		c, err := this.conn("")
+		if err != nil {
+			return err
+		}
+		if len(channels) > 0 {
+			for _, channel := range channels {
+				c.channels[channel] = true
+			}
+			if _, err := this.send(c, "subscribe", channels, false); err != nil {
+				return err
+			}
+		}
+		if len(patterns) > 0 {
+			for _, pattern := range patterns {
+				c.patterns[pattern] = true
+			}
+			if _, err := this.send(c, "psubscribe", patterns, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	var shards []string
+	for channel := range this.shards {
+		found := false
+		for _, c := range this.conns {
+			if c.shards[channel] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			shards = append(shards, channel)
+		}
+	}
+	for _, group := range groupBySlot(shards) {
+		c, err := this.conn(this.route(group[0]))
+		if err != nil {
+			return err
+		}
+		for _, channel := range group {
+			c.shards[channel] = true
+		}
+		if _, err := this.send(c, "ssubscribe", group, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the connections, and PING them.
+func (this *PubSub) ping() {
+	defer this.wg.Done()
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-this.pingReset:
+			continue
+		case <-time.After(time.Duration(atomic.LoadInt64(&this.pingInterval))):
+		}
+		this.mutex.Lock()
+		now := time.Now().UnixNano()
+		for _, c := range this.conns {
+			if c.pinged != 0 && atomic.LoadInt64(&c.received) < c.pinged && atomic.LoadInt32(&c.delivering) == 0 {
+				// no reply since the last PING, the receiver dials again
+				this.connLog(c).Warn("PubSub health check failed")
+				c.conn.Close()
+				continue
+			}
+			c.pinged = now
+			if err := c.conn.Send("PING"); err == nil {
+				c.conn.Flush()
+			}
+		}
+		this.mutex.Unlock()
+	}
+}
+
+// The logger with the node of the connection, when the PubSub logger
+// doesn't have it.
+func (this *PubSub) connLog(c *pubsubConn) Logger {
+	if c.addr == "" {
+		return this.log()
+	}
+	return LoggerWith(this.log(), "node", c.addr)
+}
+
+// Group the channels by slot, in order of first appearance.
+func groupBySlot(channels []string) [][]string {
+	var groups [][]string
+	index := make(map[uint16]int)
+	for _, channel := range channels {
+		slot := HashSlot(channel)
+		i, ok := index[slot]
+		if !ok {
+			i = len(groups)
+			index[slot] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], channel)
+	}
+	return groups
+}
+
+func isMoved(err error) bool {
+	kind, _ := parseRedirect(err)
+	return kind == "MOVED"
+}
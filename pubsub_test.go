@@ -0,0 +1,199 @@
+package goredis
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func nextMessage(t *testing.T, ps *PubSub) *Message {
+	t.Helper()
+	select {
+	case msg := <-ps.Messages():
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message")
+		return nil
+	}
+}
+
+// Publish until n subscribers receive the message, the subscriptions
+// being restored in the background. The fake server may still count a
+// connection closed by the client while it was busy, so at least n.
+func publishTo(t *testing.T, do func(string, ...interface{}) (interface{}, error), n int, cmd, channel, data string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := redis.Int(do(cmd, channel, data))
+		if err == nil && (got == n || n > 0 && got > n) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s %s: %d subscribers, %v", cmd, channel, got, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolPubSub(t *testing.T) {
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+	ps := pool.PubSub()
+	defer ps.Close()
+
+	if err := ps.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.PSubscribe("user.*"); err != nil {
+		t.Fatal(err)
+	}
+	// the pool is still usable, the subscriptions have their own connection
+	if n, err := redis.Int(pool.Do("PUBLISH", "news", "hello")); err != nil || n != 1 {
+		t.Fatal("publish:", n, err)
+	}
+	if msg := nextMessage(t, ps); msg.Kind != "message" || msg.Channel != "news" || string(msg.Data) != "hello" {
+		t.Errorf("message: %+v", msg)
+	}
+	pool.Do("PUBLISH", "user.1", "login")
+	if msg := nextMessage(t, ps); msg.Kind != "pmessage" || msg.Pattern != "user.*" || msg.Channel != "user.1" {
+		t.Errorf("message: %+v", msg)
+	}
+
+	if err := ps.Unsubscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	publishTo(t, pool.Do, 0, "PUBLISH", "news", "dropped")
+
+	// the connection is lost, the pattern is subscribed again
+	server.closeConns()
+	publishTo(t, pool.Do, 1, "PUBLISH", "user.2", "back")
+	if msg := nextMessage(t, ps); msg.Channel != "user.2" || string(msg.Data) != "back" {
+		t.Errorf("message: %+v", msg)
+	}
+	if n := server.count("PSUBSCRIBE"); n != 2 {
+		t.Error("PSUBSCRIBE sent", n, "times")
+	}
+	if n := server.count("SUBSCRIBE"); n != 1 {
+		t.Error("SUBSCRIBE sent", n, "times after the unsubscribe")
+	}
+
+	ps.Close()
+	for msg := range ps.Messages() {
+		t.Errorf("message: %+v", msg)
+	}
+	if err := ps.Subscribe("news"); err != ErrPubSubClosed {
+		t.Error("subscribe after close:", err)
+	}
+}
+
+func TestPubSubHealthCheck(t *testing.T) {
+	store := newFakeStore()
+	var hang int32
+	release := make(chan struct{})
+	defer close(release)
+	server := newFakeServer(func(c *fakeConn, args []string) interface{} {
+		if strings.ToUpper(args[0]) == "PING" && atomic.LoadInt32(&hang) == 1 {
+			// a dead server, connected but silent
+			<-release
+		}
+		return store.doConn(c, args)
+	})
+	defer server.Close()
+	handle := NewRedisHandle(server.addr, 4, 4, false)
+	defer handle.Close()
+
+	ps := handle.PubSub()
+	defer ps.Close()
+	ps.SetPingInterval(20 * time.Millisecond)
+	if err := ps.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := server.count("SUBSCRIBE"); n != 1 {
+		t.Fatal("healthy connection dialed again,", n, "SUBSCRIBE")
+	}
+
+	atomic.StoreInt32(&hang, 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for server.count("SUBSCRIBE") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("dead connection not replaced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	atomic.StoreInt32(&hang, 0)
+	publishTo(t, handle.Do, 1, "PUBLISH", "news", "alive")
+	if msg := nextMessage(t, ps); string(msg.Data) != "alive" {
+		t.Errorf("message: %+v", msg)
+	}
+}
+
+func TestClusterPubSub(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	ps := cluster.PubSub()
+	defer ps.Close()
+
+	if err := ps.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	channels := []string{"orders{1}", "orders{2}", "orders{3}", "orders{1}.eu"}
+	if err := ps.SSubscribe(channels...); err != nil {
+		t.Fatal(err)
+	}
+	// one SSUBSCRIBE per slot, on its node
+	for i, node := range fc.nodes {
+		want := 0
+		seen := make(map[uint16]bool)
+		for _, channel := range channels {
+			slot := HashSlot(channel)
+			if fc.ownerOf(slot) == i && !seen[slot] {
+				seen[slot] = true
+				want++
+			}
+		}
+		if n := node.count("SSUBSCRIBE"); n != want {
+			t.Error("node", i, "got", n, "SSUBSCRIBE, want", want)
+		}
+	}
+
+	publishTo(t, cluster.Do, 1, "PUBLISH", "news", "a")
+	if msg := nextMessage(t, ps); msg.Kind != "message" || msg.Channel != "news" {
+		t.Errorf("message: %+v", msg)
+	}
+	publishTo(t, cluster.Do, 1, "SPUBLISH", "orders{1}.eu", "b")
+	if msg := nextMessage(t, ps); msg.Kind != "smessage" || msg.Channel != "orders{1}.eu" || string(msg.Data) != "b" {
+		t.Errorf("message: %+v", msg)
+	}
+
+	// the slot moves, the node unsubscribes its shard channels and they
+	// follow it
+	slot := HashSlot("orders{1}")
+	fc.move(int(slot), int(slot), (fc.ownerOf(slot)+1)%3)
+	publishTo(t, cluster.Do, 1, "SPUBLISH", "orders{1}", "c")
+	if msg := nextMessage(t, ps); msg.Channel != "orders{1}" || string(msg.Data) != "c" {
+		t.Errorf("message: %+v", msg)
+	}
+
+	// the table is stale, SSUBSCRIBE follows MOVED
+	slot = HashSlot("late")
+	fc.move(int(slot), int(slot), (fc.ownerOf(slot)+1)%3)
+	if err := ps.SSubscribe("late"); err != nil {
+		t.Fatal(err)
+	}
+	publishTo(t, cluster.Do, 1, "SPUBLISH", "late", "d")
+	if msg := nextMessage(t, ps); msg.Channel != "late" {
+		t.Errorf("message: %+v", msg)
+	}
+
+	if err := ps.SUnsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	publishTo(t, cluster.Do, 0, "SPUBLISH", "orders{2}", "e")
+}
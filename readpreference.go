@@ -0,0 +1,117 @@
+package goredis
+
+import (
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Where RedisCluster sends the read-only commands. Writes always go to
+// the master of the slot.
+type ReadPreference int32
+
+const (
+	// Read from the master only, the default.
+	ReadMaster ReadPreference = iota
+	// Read from a replica of the slot, from the master if none is up.
+	ReadPreferReplica
+	// Read from a replica of the slot, fail if none is up.
+	ReadReplicaOnly
+	// Read from the node of the slot with the lowest measured latency.
+	ReadNearest
+	// Read from any node of the slot.
+	ReadRandom
+)
+
+var ErrNoReplica = errors.New("no replica available for this slot")
+
+func (self *RedisCluster) SetReadPreference(pref ReadPreference) {
+	atomic.StoreInt32(&self.readPreference, int32(pref))
+	if pref == ReadNearest {
+		go self.measureLatencies()
+	}
+}
+
+func (self *RedisCluster) GetReadPreference() ReadPreference {
+	return ReadPreference(atomic.LoadInt32(&self.readPreference))
+}
+
+// Return the READONLY handle of the node at addr, creating it if we
+// don't have one yet.
+func (self *RedisCluster) readerForAddr(addr string) *RedisHandle {
+	if r, ok := self.loadTable().readers[addr]; ok {
+		return r
+	}
+	self.handlesMutex.Lock()
+	defer self.handlesMutex.Unlock()
+	table := self.loadTable()
+	if r, ok := table.readers[addr]; ok {
+		return r
+	}
+	r := self.newHandle(addr, true, false)
+	readers := make(map[string]*RedisHandle)
+	for k, v := range table.readers {
+		readers[k] = v
+	}
+	readers[addr] = r
+	table = table.clone()
+	table.readers = readers
+	self.table.Store(table)
+	return r
+}
+
+// Pick the node serving a read of the slot according to pref. It returns
+// nil when the master should serve it, and ErrNoReplica when no replica
+// of the slot is known under ReadReplicaOnly.
+func (self *RedisCluster) readerForSlot(table *clusterTable, slot uint16, pref ReadPreference) (*RedisHandle, error) {
+	master, ok := table.master(slot)
+	if !ok {
+		if pref == ReadReplicaOnly {
+			return nil, ErrNoReplica
+		}
+		return nil, nil
+	}
+	replicas := table.replicas[master]
+	var addr string
+	switch pref {
+	case ReadPreferReplica, ReadReplicaOnly:
+		if len(replicas) == 0 {
+			if pref == ReadReplicaOnly {
+				return nil, ErrNoReplica
+			}
+			return nil, nil
+		}
+		addr = replicas[rand.Intn(len(replicas))]
+	case ReadRandom:
+		if i := rand.Intn(len(replicas) + 1); i < len(replicas) {
+			addr = replicas[i]
+		}
+	case ReadNearest:
+		latencies, _ := self.latencies.Load().(map[string]time.Duration)
+		best, ok := latencies[master]
+		for _, replica := range replicas {
+			if l, found := latencies[replica]; found && (!ok || l < best) {
+				addr, best, ok = replica, l, true
+			}
+		}
+	}
+	if addr == "" {
+		return nil, nil
+	}
+	return self.readerForAddr(addr), nil
+}
+
+// Measure the round trip to every node with a PING, for ReadNearest.
+// Unreachable nodes are left out.
+func (self *RedisCluster) measureLatencies() {
+	table := self.loadTable()
+	latencies := make(map[string]time.Duration)
+	for addr, _ := range table.seedHosts {
+		start := time.Now()
+		if _, err := self.handleForAddr(addr).Do("PING"); err == nil {
+			latencies[addr] = time.Since(start)
+		}
+	}
+	self.latencies.Store(latencies)
+}
@@ -0,0 +1,156 @@
+package goredis
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Start a cluster of 3 masters with one replica each, and a client.
+func newReplicatedCluster(t *testing.T) (*fakeCluster, *RedisCluster) {
+	fc := newFakeCluster(3)
+	for i := 0; i < 3; i++ {
+		fc.addReplica(i)
+	}
+	cluster := NewRedisCluster(fc.addrs()[:1], 8, 8, false)
+	if len(cluster.Topology().Masters) != 3 {
+		t.Fatal("masters:", len(cluster.Topology().Masters))
+	}
+	return fc, cluster
+}
+
+func TestClusterReadMaster(t *testing.T) {
+	fc, cluster := newReplicatedCluster(t)
+	defer fc.Close()
+	defer cluster.Close()
+
+	if _, err := cluster.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cluster.Do("GET", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	for _, replica := range fc.replicasOf(fc.ownerOf(HashSlot("foo"))) {
+		if n := fc.nodes[replica].count("GET"); n != 0 {
+			t.Error("replica served", n, "reads")
+		}
+	}
+}
+
+func TestClusterReadPreferReplica(t *testing.T) {
+	fc, cluster := newReplicatedCluster(t)
+	defer fc.Close()
+	defer cluster.Close()
+	cluster.SetReadPreference(ReadPreferReplica)
+
+	master := fc.ownerOf(HashSlot("foo"))
+	replica := fc.replicasOf(master)[0]
+	if _, err := cluster.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	rp, err := cluster.Do("GET", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rp.([]byte)) != "bar" {
+		t.Fatal(rp)
+	}
+	if fc.nodes[master].count("SET") != 1 || fc.nodes[replica].count("SET") != 0 {
+		t.Error("writes must go to the master")
+	}
+	if fc.nodes[replica].count("GET") != 1 || fc.nodes[master].count("GET") != 0 {
+		t.Error("reads must go to the replica")
+	}
+	if fc.nodes[replica].count("READONLY") == 0 {
+		t.Error("READONLY not sent to the replica")
+	}
+
+	// the error of the command is not retried on the master
+	if _, err := cluster.Do("FCALL_RO", "missing", 1, "foo"); err == nil {
+		t.Fatal("missing function")
+	}
+	if fc.nodes[replica].count("FCALL_RO") != 1 || fc.nodes[master].count("FCALL_RO") != 0 {
+		t.Error("FCALL_RO retried on the master")
+	}
+
+	// reads fall back to the master once the replica is down
+	fc.nodes[replica].Close()
+	if _, err := cluster.Do("GET", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if fc.nodes[master].count("GET") != 1 {
+		t.Error("read not served by the master")
+	}
+}
+
+func TestClusterReadReplicaOnly(t *testing.T) {
+	fc, cluster := newReplicatedCluster(t)
+	defer fc.Close()
+	defer cluster.Close()
+	cluster.SetReadPreference(ReadReplicaOnly)
+
+	master := fc.ownerOf(HashSlot("foo"))
+	replica := fc.replicasOf(master)[0]
+	if _, err := cluster.Do("GET", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	fc.nodes[replica].Close()
+	if _, err := cluster.Do("GET", "foo"); err == nil {
+		t.Fatal("read served without replica")
+	}
+	if fc.nodes[master].count("GET") != 0 {
+		t.Error("read served by the master")
+	}
+}
+
+func TestClusterReadReplicaOnlyUnknownSlot(t *testing.T) {
+	fc, cluster := newReplicatedCluster(t)
+	defer fc.Close()
+	defer cluster.Close()
+	cluster.SetReadPreference(ReadReplicaOnly)
+
+	// the slot of foo lost its master in the table
+	slot := HashSlot("foo")
+	table := cluster.loadTable().clone()
+	table.slots = make(map[uint16]string)
+	for s, addr := range cluster.loadTable().slots {
+		if s != slot {
+			table.slots[s] = addr
+		}
+	}
+	cluster.table.Store(table)
+
+	if _, err := cluster.Do("GET", "foo"); !errors.Is(err, ErrNoReplica) {
+		t.Fatal(err)
+	}
+	if fc.count("GET") != 0 {
+		t.Error("read served without a known replica")
+	}
+}
+
+func TestClusterReadNearestAndRandom(t *testing.T) {
+	fc, cluster := newReplicatedCluster(t)
+	defer fc.Close()
+	defer cluster.Close()
+
+	for _, pref := range []ReadPreference{ReadNearest, ReadRandom} {
+		cluster.SetReadPreference(pref)
+		if pref == ReadNearest {
+			for cluster.latencies.Load() == nil {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		for i := 0; i < 20; i++ {
+			if _, err := cluster.Do("GET", "foo"); err != nil {
+				t.Fatal(pref, err)
+			}
+		}
+	}
+	reads := 0
+	for _, node := range fc.nodes {
+		reads += node.count("GET")
+	}
+	if reads != 40 {
+		t.Error("reads:", reads)
+	}
+}
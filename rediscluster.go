@@ -1,94 +1,237 @@
 package goredis
 
 import "strings"
-import "strconv"
 import "errors"
 import "math/rand"
 import "os"
 import "fmt"
+import "sync"
+import "sync/atomic"
+import "context"
+import "time"
+
+import "github.com/garyburd/redigo/redis"
 
 const RedisClusterHashSlots = 16384
 const RedisClusterRequestTTL = 16
 const RedisClusterDefaultTimeout = 1
 
+// The default minimum time between two refreshes of the slots triggered by
+// redirections, see SetMinRefreshInterval.
+const RedisClusterMinRefreshInterval = 100 * time.Millisecond
+
+// The errors returned by RedisCluster. Those carrying details wrap one of
+// them, test them with errors.Is.
+var (
+	ErrClusterDisabled  = errors.New("multiple seed hosts given, but cluster support disabled in redis")
+	ErrNoKey            = errors.New("no way to dispatch this type of command to redis cluster")
+	ErrCrossSlot        = errors.New("keys in request don't hash to the same slot")
+	ErrTooManyRedirects = errors.New("could not complete command, too many redirections")
+	ErrNoHandle         = errors.New("no redis handle found")
+)
+
+// The commands without keys which any node serves: PUBLISH is broadcast
+// to the whole cluster, and the scripts and functions may have no keys.
+var anyNodeCommands = map[string]bool{
+	"publish": true, "eval": true, "eval_ro": true, "evalsha": true,
+	"evalsha_ro": true, "fcall": true, "fcall_ro": true,
+}
+
+// RedisCluster is safe for concurrent use. The routing table is an
+// immutable snapshot which is replaced as a whole when the topology
+// changes, so readers never lock.
 type RedisCluster struct {
-	SeedHosts        map[string]bool
-	Handles          map[string]*RedisHandle
-	Slots            map[uint16]string
-	RefreshTableASAP bool
-	SingleRedisMode  bool
-	MaxIdle          int
-	MaxActive        int
-	Debug            bool
+	// first for the alignment of the 64 bits atomics
+	refreshDelay int64 // minimum time.Duration between two refreshes
+	lastRefresh  int64 // unix nano of the last refresh
+	failLimit    rateLimit
+
+	MaxIdle   int
+	MaxActive int
+	Debug     bool
+
+	table         atomic.Value // *clusterTable
+	handlesMutex  sync.Mutex   // serializes the table updates
+	refreshMutex  sync.Mutex   // at most one refresh in flight
+	refreshNeeded int32
+	refreshing    int32
+	periodic      chan struct{} // closed to stop the periodic refresh
+	closed        chan struct{}
+	closeOnce     sync.Once
+
+	readPreference int32        // ReadPreference
+	latencies      atomic.Value // map[string]time.Duration
+
+	options DialOptions
+	err     error        // set by DialCluster, returned by every command
+	logger  atomic.Value // loggerHolder
+	hooks   atomic.Value // *hookList
 }
 
-func NewRedisCluster(addrs []string, max_idle, max_active int, debug bool) RedisCluster {
-	cluster := RedisCluster{RefreshTableASAP: false,
-		SingleRedisMode: false,
-		SeedHosts:       make(map[string]bool),
-		Handles:         make(map[string]*RedisHandle),
-		Slots:           make(map[uint16]string),
-		MaxActive:       max_active,
-		Debug:           debug}
+// A snapshot of the cluster topology. It must not be modified once
+// stored, copy it instead.
+type clusterTable struct {
+	seedHosts map[string]bool
+	handles   map[string]*RedisHandle
+	readers   map[string]*RedisHandle // READONLY connections to replicas
+	slots     map[uint16]string
+	moved     *sync.Map           // slot → address, told by MOVED since the refresh
+	replicas  map[string][]string // healthy replicas by master
+	topology  *ClusterTopology
+	single    bool
+	epoch     uint64 // incremented by every refresh
+}
 
-	if cluster.Debug {
-		fmt.Println("[RedisCluster], PID", os.Getpid(), "StartingNewRedisCluster")
-	}
+var emptyClusterTable = newClusterTable()
 
-	for _, label := range addrs {
-		cluster.SeedHosts[label] = true
-		cluster.Handles[label] = NewRedisHandle(label, max_idle, max_active, debug)
+func newClusterTable() *clusterTable {
+	return &clusterTable{
+		seedHosts: make(map[string]bool),
+		handles:   make(map[string]*RedisHandle),
+		readers:   make(map[string]*RedisHandle),
+		slots:     make(map[uint16]string),
+		replicas:  make(map[string][]string),
+		topology:  &ClusterTopology{},
 	}
+}
+
+// Return a shallow copy, to replace some of the maps.
+func (t *clusterTable) clone() *clusterTable {
+	c := *t
+	return &c
+}
 
-	for addr, _ := range cluster.SeedHosts {
-		node, ok := cluster.Handles[addr]
-		if !ok {
-			node = NewRedisHandle(addr, cluster.MaxIdle, cluster.MaxActive, cluster.Debug)
-			cluster.Handles[addr] = node
+// Return the address of the master serving the slot, the redirections
+// overriding the slots of the refresh.
+func (t *clusterTable) master(slot uint16) (string, bool) {
+	if t.moved != nil {
+		if addr, ok := t.moved.Load(slot); ok {
+			return addr.(string), true
 		}
+	}
+	addr, ok := t.slots[slot]
+	return addr, ok
+}
+
+// Return the handles of every node, replica readers included.
+func (t *clusterTable) allHandles() []*RedisHandle {
+	handles := make([]*RedisHandle, 0, len(t.handles)+len(t.readers))
+	for _, handle := range t.handles {
+		handles = append(handles, handle)
+	}
+	for _, handle := range t.readers {
+		handles = append(handles, handle)
+	}
+	return handles
+}
+
+// Create a cluster client. A configuration error is returned by every
+// command, use DialCluster to check it at once.
+func NewRedisCluster(addrs []string, max_idle, max_active int, debug bool) *RedisCluster {
+	cluster, _ := DialCluster(addrs, max_idle, max_active, debug)
+	return cluster
+}
+
+// Create a cluster client and return the configuration error if any, such
+// as ErrClusterDisabled. The client is returned in any case, it fails every
+// command with that error.
+func DialCluster(addrs []string, max_idle, max_active int, debug bool) (*RedisCluster, error) {
+	return DialClusterWithOptions(addrs, max_idle, max_active, debug, DialOptions{})
+}
+
+// Same as DialCluster, the options apply to the connections to every node,
+// including the ones found by the refreshes of the slots.
+func DialClusterWithOptions(addrs []string, max_idle, max_active int, debug bool, options DialOptions) (*RedisCluster, error) {
+	cluster := &RedisCluster{
+		MaxIdle:      max_idle,
+		MaxActive:    max_active,
+		Debug:        debug,
+		refreshDelay: int64(RedisClusterMinRefreshInterval),
+		closed:       make(chan struct{}),
+		options:      options}
+
+	cluster.log().Debug("StartingNewRedisCluster", "pid", os.Getpid(), "seeds", addrs)
+
+	table := newClusterTable()
+	for _, label := range addrs {
+		table.seedHosts[label] = true
+		table.handles[label] = cluster.newHandle(label, false, false)
+	}
 
+	for addr, _ := range table.seedHosts {
+		node := table.handles[addr]
 		cluster_enabled := cluster.hasClusterEnabled(node)
 		if cluster_enabled == false {
-			if len(cluster.SeedHosts) == 1 {
-				cluster.SingleRedisMode = true
+			if len(table.seedHosts) == 1 {
+				table.single = true
 			} else {
-				panic(errors.New("Multiple Seed Hosts Given, But Cluster Support Disabled in Redis"))
+				cluster.err = ErrClusterDisabled
 			}
 		}
 	}
+	if table.single {
+		table.handles = cluster.singleHandles(table)
+	}
+	cluster.table.Store(table)
 
-	if cluster.SingleRedisMode == false {
+	if table.single == false && cluster.err == nil {
 		cluster.populateSlotsCache()
 	}
-	return cluster
+	return cluster, cluster.err
+}
+
+func (self *RedisCluster) loadTable() *clusterTable {
+	if table, ok := self.table.Load().(*clusterTable); ok {
+		return table
+	}
+	return emptyClusterTable
+}
+
+// Return the topology found by the last refresh.
+func (self *RedisCluster) Topology() *ClusterTopology {
+	return self.loadTable().topology
 }
 
 func (self *RedisCluster) Update(max_idle, max_active int32) {
-	for _, rh := range self.Handles {
-		rh.Pool.Update(max_idle, max_active)
+	for _, rh := range self.loadTable().allHandles() {
+		rh.pool.Update(max_idle, max_active)
 	}
 }
 
 func (self *RedisCluster) SetWaitTime(t int) {
-	for _, rh := range self.Handles {
-		rh.Pool.SetWaitTime(t)
+	for _, rh := range self.loadTable().allHandles() {
+		rh.pool.SetWaitTime(t)
 	}
 }
 
 func (self *RedisCluster) SetLifeTime(t int) {
-	for _, rh := range self.Handles {
-		rh.Pool.SetLifeTime(t)
+	for _, rh := range self.loadTable().allHandles() {
+		rh.pool.SetLifeTime(t)
 	}
 }
 
 func (self *RedisCluster) SetPingTime(t int) {
-	for _, rh := range self.Handles {
-		rh.Pool.SetPingTime(t)
+	for _, rh := range self.loadTable().allHandles() {
+		rh.pool.SetPingTime(t)
+	}
+}
+
+// Return the stats of the pools by node address, summing the READONLY
+// pool of a replica with its other pool.
+func (self *RedisCluster) Stats() map[string]PoolStats {
+	table := self.loadTable()
+	stats := make(map[string]PoolStats)
+	for addr, rh := range table.handles {
+		stats[addr] = stats[addr].Add(rh.pool.Stats())
+	}
+	for addr, rh := range table.readers {
+		stats[addr] = stats[addr].Add(rh.pool.Stats())
 	}
+	return stats
 }
 
 func (self *RedisCluster) TestCluster() error {
-	for _, rh := range self.Handles {
+	for _, rh := range self.loadTable().handles {
 		_, err := rh.Do("CLUSTER", "INFO")
 		if err != nil {
 			return err
@@ -105,6 +248,10 @@ func (self *RedisCluster) Do(cmd string, args ...interface{}) (reply interface{}
 	return self.SendClusterCommand(cmd, args...)
 }
 
+func (self *RedisCluster) DoContext(ctx context.Context, cmd string, args ...interface{}) (reply interface{}, err error) {
+	return self.SendClusterCommandContext(ctx, cmd, args...)
+}
+
 func (self *RedisCluster) hasClusterEnabled(node *RedisHandle) bool {
 	_, err := node.Do("CLUSTER", "INFO")
 	if err != nil {
@@ -116,350 +263,612 @@ func (self *RedisCluster) hasClusterEnabled(node *RedisHandle) bool {
 	return true
 }
 
+// Refresh the slots cache unless the table was already refreshed since
+// stale was loaded, in which case somebody else did the work while we
+// were waiting. A nil stale forces the refresh.
+func (self *RedisCluster) refreshTable(stale *clusterTable) {
+	self.refreshMutex.Lock()
+	defer self.refreshMutex.Unlock()
+	if stale != nil && self.loadTable().epoch != stale.epoch {
+		return
+	}
+	self.populateSlotsCache()
+}
+
+// Refresh the table in the background, unless a refresh is running
+// already. The refresh waits for the minimum interval since the previous
+// one, the redirections being followed meanwhile.
+func (self *RedisCluster) scheduleRefresh(stale *clusterTable) {
+	if !atomic.CompareAndSwapInt32(&self.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&self.refreshing, 0)
+		last := atomic.LoadInt64(&self.lastRefresh)
+		wait := time.Duration(last + atomic.LoadInt64(&self.refreshDelay) - time.Now().UnixNano())
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-self.closed:
+				return
+			}
+		}
+		self.refreshTable(stale)
+	}()
+}
+
+// Set the minimum time between two refreshes of the slots triggered by
+// MOVED redirections, RedisClusterMinRefreshInterval by default.
+func (self *RedisCluster) SetMinRefreshInterval(d time.Duration) {
+	atomic.StoreInt64(&self.refreshDelay, int64(d))
+}
+
+// Refresh the slots every d in the background, to notice the topology
+// changes before the redirections do. A zero d stops it, which is the
+// default.
+func (self *RedisCluster) SetRefreshInterval(d time.Duration) {
+	self.handlesMutex.Lock()
+	defer self.handlesMutex.Unlock()
+	if self.periodic != nil {
+		close(self.periodic)
+		self.periodic = nil
+	}
+	if d <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	self.periodic = stop
+	go func() {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				self.refreshTable(self.loadTable())
+			case <-stop:
+				return
+			case <-self.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Route the slot to addr at once, as told by a MOVED redirection, until
+// the next refresh replaces the whole table.
+func (self *RedisCluster) updateSlot(slot uint16, addr string) {
+	table := self.loadTable()
+	if table.moved == nil {
+		return
+	}
+	if current, _ := table.master(slot); current == addr {
+		return
+	}
+	self.handleForAddr(addr)
+	table.moved.Store(slot, addr)
+}
+
+// Fetch the topology from the node, with CLUSTER SLOTS which every
+// cluster version supports, then CLUSTER SHARDS for the servers which
+// dropped it, and CLUSTER NODES as a last resort.
+func (self *RedisCluster) fetchTopology(node *RedisHandle) (*ClusterTopology, error) {
+	reply, err := node.Do("CLUSTER", "SLOTS")
+	if err == nil {
+		topology, err := ParseClusterSlots(reply, node.Addr)
+		if err == nil {
+			return topology, nil
+		}
+	}
+	reply, err = node.Do("CLUSTER", "SHARDS")
+	if err == nil {
+		topology, err := ParseClusterShards(reply, node.Addr)
+		if err == nil {
+			return topology, nil
+		}
+	}
+	nodes, err := redis.String(node.Do("CLUSTER", "NODES"))
+	if err != nil {
+		return nil, err
+	}
+	return ParseClusterNodes(nodes, node.Addr)
+}
+
 // contact the startup nodes and try to fetch the hash slots -> instances
 // map in order to initialize the Slots map.
 func (self *RedisCluster) populateSlotsCache() {
-	if self.SingleRedisMode == true {
+	table := self.loadTable()
+	if table.single == true {
 		return
 	}
-	if self.Debug {
-		fmt.Println("[RedisCluster], PID", os.Getpid(), "[PopulateSlots Running]")
-	}
+	self.log().Debug("PopulateSlots Running", "pid", os.Getpid())
+	atomic.StoreInt64(&self.lastRefresh, time.Now().UnixNano())
 	seedHosts := make(map[string]bool)
-	handles := make(map[string]*RedisHandle)
-	slotsMap := make(map[uint16]string)
-	for k, v := range self.SeedHosts {
+	var topology *ClusterTopology
+	for k, v := range table.seedHosts {
 		seedHosts[k] = v
 	}
-	for k, v := range self.Handles {
-		handles[k] = v
+	for name, _ := range table.seedHosts {
+		self.log().Debug("PopulateSlots Checking", "node", name)
+		var err error
+		topology, err = self.fetchTopology(self.handleForAddr(name))
+		if err == nil {
+			break
+		}
+		self.log().Warn("PopulateSlots Failed", "node", name, "error", err)
+	}
+	if topology == nil {
+		// nobody answered, keep what we have
+		return
 	}
-	for k, v := range self.Slots {
-		slotsMap[k] = v
+	// add to seedlist if not in cluster
+	for _, addr := range topology.Addrs() {
+		seedHosts[addr] = true
 	}
-	for name, _ := range self.SeedHosts {
-		if self.Debug {
-			fmt.Println("[RedisCluster] [PopulateSlots] Checking: ", name)
+	slotsMap := topology.Slots()
+	self.log().Debug("Initializing DONE", "slots", len(slotsMap), "nodes", len(seedHosts))
+
+	// reuse the handles of the nodes we already know, and close the
+	// ones which are not part of the cluster anymore
+	self.handlesMutex.Lock()
+	table = self.loadTable()
+	handles := make(map[string]*RedisHandle)
+	readers := make(map[string]*RedisHandle)
+	var removed []*RedisHandle
+	for addr, handle := range table.handles {
+		if seedHosts[addr] {
+			handles[addr] = handle
+		} else {
+			removed = append(removed, handle)
 		}
-		var (
-			node *RedisHandle
-			ok   bool
-		)
-		if node, ok = handles[name]; !ok {
-			node = NewRedisHandle(name, self.MaxIdle, self.MaxActive, self.Debug)
-			handles[name] = node
+	}
+	for addr, handle := range table.readers {
+		if seedHosts[addr] {
+			readers[addr] = handle
+		} else {
+			removed = append(removed, handle)
 		}
-		cluster_info, err := node.Do("CLUSTER", "NODES")
-		if err == nil {
-			lines := strings.Split(string(cluster_info.([]uint8)), "\n")
-			for _, line := range lines {
-				if line != "" {
-					fields := strings.Split(line, " ")
-					addr := fields[1]
-					if addr == ":0" {
-						addr = name
-					}
-					// add to seedlist if not in cluster
-					seedHosts[addr] = true
-
-					// add to handles if not in handles
-					if _, ok := handles[name]; !ok {
-						handles[name] = NewRedisHandle(addr, self.MaxIdle, self.MaxActive, self.Debug)
-					}
-
-					slots := fields[8:len(fields)]
-					for _, s_range := range slots {
-						slot_range := s_range
-						if slot_range != "[" {
-							if self.Debug {
-								fmt.Println("[RedisCluster] Considering Slot Range", slot_range)
-							}
-							r_pieces := strings.Split(slot_range, "-")
-							min, _ := strconv.Atoi(r_pieces[0])
-							max, _ := strconv.Atoi(r_pieces[1])
-							for i := min; i <= max; i++ {
-								slotsMap[uint16(i)] = addr
-							}
-						}
-					}
-				}
-			}
-			if self.Debug {
-				fmt.Println("[RedisCluster] [Initializing] DONE, ",
-					"Slots: ", len(slotsMap),
-					"Handles So Far:", len(handles),
-					"SeedList:", len(seedHosts))
+	}
+	for addr, _ := range seedHosts {
+		if _, ok := handles[addr]; !ok {
+			handles[addr] = self.newHandle(addr, false, false)
+		}
+	}
+	replicas := make(map[string][]string)
+	for _, master := range topology.Masters {
+		for _, replica := range master.Replicas {
+			if !replica.Failed {
+				replicas[master.Addr] = append(replicas[master.Addr], replica.Addr)
 			}
-			break
 		}
 	}
-	self.SeedHosts = seedHosts
-	self.Handles = handles
-	self.Slots = slotsMap
+	self.table.Store(&clusterTable{
+		seedHosts: seedHosts,
+		handles:   handles,
+		readers:   readers,
+		slots:     slotsMap,
+		moved:     new(sync.Map),
+		replicas:  replicas,
+		topology:  topology,
+		single:    table.single,
+		epoch:     table.epoch + 1,
+	})
+	self.handlesMutex.Unlock()
+
+	for _, handle := range removed {
+		handle.pool.Close()
+	}
+	if self.GetReadPreference() == ReadNearest {
+		self.measureLatencies()
+	}
 	self.switchToSingleModeIfNeeded()
 }
 
+// Return a new handle for the node at addr. The database is only selected
+// on a standalone server.
+func (self *RedisCluster) newHandle(addr string, readonly, single bool) *RedisHandle {
+	options := self.options
+	if !single {
+		options.Database = 0
+	}
+	handle := newRedisHandle(addr, self.MaxIdle, self.MaxActive, self.Debug, readonly, options)
+	for _, hook := range loadHooks(&self.hooks) {
+		handle.AddHook(dialHook{hook: hook})
+	}
+	if readonly {
+		handle.SetLogger(LoggerWith(self.log(), "node", addr, "readonly", true))
+	} else {
+		handle.SetLogger(LoggerWith(self.log(), "node", addr))
+	}
+	return handle
+}
+
+// Set the logger of the cluster and of the pools of its nodes. By default
+// the debug messages are printed to stdout when Debug is set, and the
+// others go to the standard log package.
+func (self *RedisCluster) SetLogger(logger Logger) {
+	self.handlesMutex.Lock()
+	defer self.handlesMutex.Unlock()
+	self.logger.Store(loggerHolder{logger})
+	for addr, rh := range self.loadTable().handles {
+		rh.SetLogger(LoggerWith(logger, "node", addr))
+	}
+	for addr, rh := range self.loadTable().readers {
+		rh.SetLogger(LoggerWith(logger, "node", addr, "readonly", true))
+	}
+}
+
+// Add a hook seeing the commands and pipelines sent to the cluster, and
+// the dials to its nodes.
+func (self *RedisCluster) AddHook(hook Hook) {
+	self.handlesMutex.Lock()
+	defer self.handlesMutex.Unlock()
+	addHook(&self.hooks, hook)
+	for _, rh := range self.loadTable().allHandles() {
+		rh.AddHook(dialHook{hook: hook})
+	}
+}
+
+func (self *RedisCluster) log() Logger {
+	if holder, ok := self.logger.Load().(loggerHolder); ok {
+		return holder.Logger
+	}
+	return stdLogger{prefix: "[RedisCluster] ", debug: self.Debug}
+}
+
+// Return the handles of the table for single mode, replacing and closing
+// the ones which must select another database.
+func (self *RedisCluster) singleHandles(table *clusterTable) map[string]*RedisHandle {
+	if self.options.Database == 0 {
+		return table.handles
+	}
+	handles := make(map[string]*RedisHandle)
+	for addr, handle := range table.handles {
+		handle.pool.Close()
+		handles[addr] = self.newHandle(addr, false, true)
+	}
+	return handles
+}
+
 func (self *RedisCluster) switchToSingleModeIfNeeded() {
 	// catch case where we really intend to be on
 	// single redis mode, but redis was not
 	// started on time
-	if len(self.SeedHosts) == 1 &&
-		len(self.Slots) == 0 &&
-		len(self.Handles) == 1 {
-		for _, node := range self.Handles {
+	table := self.loadTable()
+	if table.single == false &&
+		len(table.seedHosts) == 1 &&
+		len(table.slots) == 0 &&
+		len(table.handles) == 1 {
+		for _, node := range table.handles {
 			cluster_enabled := self.hasClusterEnabled(node)
 			if cluster_enabled == false {
-				self.SingleRedisMode = true
+				self.handlesMutex.Lock()
+				table = self.loadTable()
+				single := table.clone()
+				single.single = true
+				single.handles = self.singleHandles(table)
+				self.table.Store(single)
+				self.handlesMutex.Unlock()
 			}
 		}
 	}
 }
 
+// Return the first key of the request, or "" for commands without keys.
 func (self *RedisCluster) KeyForRequest(cmd string, args ...interface{}) string {
-	cmd = strings.ToLower(cmd)
-	if cmd == "info" ||
-		cmd == "multi" ||
-		cmd == "exec" ||
-		cmd == "slaveof" ||
-		cmd == "config" ||
-		cmd == "shutdown" {
+	keys := KeysForCommand(cmd, args...)
+	if len(keys) == 0 {
 		return ""
 	}
-	if args[0] == nil {
-		return ""
-	}
-	strs := args[0].([]interface{})
-	if strs != nil && strs[0] != nil {
-		return strs[0].(string)
-	}
-	return ""
+	return keys[0]
+}
+
+// Return all the keys of the request.
+func (self *RedisCluster) KeysForRequest(cmd string, args ...interface{}) []string {
+	return KeysForCommand(cmd, args...)
 }
 
 // Return the hash slot from the key.
 func (self *RedisCluster) SlotForKey(key string) uint16 {
-	checksum := ChecksumCRC16([]byte(key))
-	slot := checksum % RedisClusterHashSlots
-	return slot
+	return HashSlot(key)
+}
+
+// Return the part of the key that is hashed, following the hash tag rule
+// of the cluster spec: if the key contains a "{" followed by a "}" with at
+// least one character between them, only that substring is hashed.
+func HashTag(key string) string {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			return key[s+1 : s+1+e]
+		}
+	}
+	return key
+}
+
+// Return the hash slot of the key, honoring hash tags.
+func HashSlot(key string) uint16 {
+	checksum := ChecksumCRC16([]byte(HashTag(key)))
+	return checksum % RedisClusterHashSlots
 }
 
 func (self *RedisCluster) RandomRedisHandle() *RedisHandle {
-	if len(self.Handles) == 0 {
+	table := self.loadTable()
+	if len(table.handles) == 0 {
 		return nil
 	}
-	addrs := make([]string, len(self.Handles))
+	addrs := make([]string, len(table.handles))
 	i := 0
-	for addr, _ := range self.Handles {
+	for addr, _ := range table.handles {
 		addrs[i] = addr
 		i++
 	}
-	rand_addrs := make([]string, i)
-	perm := rand.Perm(i)
-	for j, v := range perm {
-		rand_addrs[v] = addrs[j]
-	}
-	handle := self.Handles[rand_addrs[0]]
+	handle := table.handles[addrs[rand.Intn(i)]]
 	self.switchToSingleModeIfNeeded()
 	return handle
 }
 
+// Return the handle of the node at addr, creating it if we don't have
+// one yet.
+func (self *RedisCluster) handleForAddr(addr string) *RedisHandle {
+	if r, ok := self.loadTable().handles[addr]; ok {
+		return r
+	}
+	self.handlesMutex.Lock()
+	defer self.handlesMutex.Unlock()
+	table := self.loadTable()
+	if r, ok := table.handles[addr]; ok {
+		return r
+	}
+	r := self.newHandle(addr, false, table.single)
+	handles := make(map[string]*RedisHandle)
+	for k, v := range table.handles {
+		handles[k] = v
+	}
+	handles[addr] = r
+	table = table.clone()
+	table.handles = handles
+	self.table.Store(table)
+	return r
+}
+
 // Given a slot return the link (Redis instance) to the mapped node.
 // Make sure to create a connection with the node if we don't have
 // one.
 func (self *RedisCluster) RedisHandleForSlot(slot uint16) *RedisHandle {
-
-	node, exists := self.Slots[slot]
+	table := self.loadTable()
+	node, exists := table.master(slot)
 	// If we don't know what the mapping is, return a random node.
 	if !exists {
-		if self.Debug {
-			fmt.Println("[RedisCluster] No One Appears Responsible For Slot: ", slot, "our slotsize is: ", len(self.Slots))
-		}
+		self.log().Debug("No One Appears Responsible For Slot", "slot", slot, "slots", len(table.slots))
 		return self.RandomRedisHandle()
 	}
+	// XXX consider returning random if failure
+	return self.handleForAddr(node)
+}
 
-	r, cx_exists := self.Handles[node]
-	// add to cluster if not in cluster
-	if cx_exists {
-		return r
-	} else {
-		r = NewRedisHandle(node, self.MaxIdle, self.MaxActive, self.Debug)
-		handles := make(map[string]*RedisHandle)
-		for k, v := range self.Handles {
-			handles[k] = v
+// Close the connections to every node.
+func (self *RedisCluster) Close() {
+	self.closeOnce.Do(func() {
+		if self.closed != nil {
+			close(self.closed)
 		}
-		handles[node] = r
-		self.Handles = handles
+	})
+	self.handlesMutex.Lock()
+	table := self.loadTable()
+	self.table.Store(emptyClusterTable)
+	self.handlesMutex.Unlock()
+	self.log().Debug("Disconnect", "pid", os.Getpid(), "handles", len(table.handles))
+	for _, handle := range table.allHandles() {
+		handle.pool.Close()
 	}
-	// XXX consider returning random if failure
-	return r
 }
 
-func (self *RedisCluster) disconnectAll() {
-	if self.Debug {
-		fmt.Println("[RedisCluster] PID:", os.Getpid(), " [Disconnect!] Had Handles:", len(self.Handles))
-	}
-	// disconnect anyone in handles
-	for _, handle := range self.Handles {
-		handle.Pool.Close()
+func (self *RedisCluster) handleSingleMode(ctx context.Context, info *CommandInfo, table *clusterTable, flush bool, cmd string, args ...interface{}) (reply interface{}, err error) {
+	for _, handle := range table.handles {
+		info.Addr = handle.Addr
+		return handle.DoContext(ctx, cmd, args...)
 	}
-	self.Handles = make(map[string]*RedisHandle)
+	return nil, ErrNoHandle
+}
 
-	// nuke slots
-	self.Slots = make(map[uint16]string)
+func (self *RedisCluster) SendClusterCommand(cmd string, args ...interface{}) (reply interface{}, err error) {
+	return self.SendClusterCommandContext(context.Background(), cmd, args...)
 }
 
-func (self *RedisCluster) handleSingleMode(flush bool, cmd string, args ...interface{}) (reply interface{}, err error) {
-	for _, handle := range self.Handles {
-		return handle.Do(cmd, args...)
-	}
-	return nil, errors.New("no redis handle found for single mode")
+// Same as SendClusterCommand, but give up once ctx is done, whether
+// waiting for a connection, dialing, talking to a node or between the
+// redirections.
+func (self *RedisCluster) SendClusterCommandContext(ctx context.Context, cmd string, args ...interface{}) (reply interface{}, err error) {
+	info := &CommandInfo{Name: cmd, Args: args, Slot: -1}
+	if hooks := loadHooks(&self.hooks); len(hooks) > 0 {
+		return hooks.process(ctx, info, func(ctx context.Context) (interface{}, error) {
+			return self.sendClusterCommand(ctx, info)
+		})
+	}
+	return self.sendClusterCommand(ctx, info)
 }
 
-func (self *RedisCluster) SendClusterCommand(cmd string, args ...interface{}) (reply interface{}, err error) {
+// Send the command of info, and record where it went in info.
+func (self *RedisCluster) sendClusterCommand(ctx context.Context, info *CommandInfo) (reply interface{}, err error) {
 	var flush bool = true
+	cmd, args := info.Name, info.Args
+
+	if self.err != nil {
+		return nil, self.err
+	}
+
+	if atomic.CompareAndSwapInt32(&self.refreshNeeded, 1, 0) {
+		self.log().Debug("Refresh Needed")
+		self.refreshTable(nil)
+	}
+
 	// forward onto first redis in the handle
 	// if we are set to single mode
-	if self.SingleRedisMode == true {
-		return self.handleSingleMode(flush, cmd, args...)
+	table := self.loadTable()
+	if table.single == true {
+		return self.handleSingleMode(ctx, info, table, flush, cmd, args...)
+	}
+
+	if requests := splitBySlot(cmd, args); requests != nil {
+		return self.sendMultiKeyCommand(ctx, cmd, requests)
 	}
 
-	if self.RefreshTableASAP == true {
-		if self.Debug {
-			fmt.Println("[RedisCluster] Refresh Needed")
+	keys := self.KeysForRequest(cmd, args...)
+	if len(keys) == 0 && anyNodeCommands[strings.ToLower(cmd)] {
+		handle := self.RandomRedisHandle()
+		if handle == nil {
+			return nil, ErrNoHandle
 		}
-		self.disconnectAll()
-		self.populateSlotsCache()
-		self.RefreshTableASAP = false
-		// in case we realized we were now in Single Mode
-		if self.SingleRedisMode == true {
-			return self.handleSingleMode(flush, cmd, args...)
+		info.Addr = handle.Addr
+		return handle.DoContext(ctx, cmd, args...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoKey, cmd)
+	}
+	for _, k := range keys[1:] {
+		if HashSlot(k) != HashSlot(keys[0]) {
+			return nil, fmt.Errorf("%w: %s", ErrCrossSlot, cmd)
 		}
 	}
 
 	ttl := RedisClusterRequestTTL
-	key := self.KeyForRequest(cmd, args)
+	key := keys[0]
+	var last_err error
 	try_random_node := false
 	asking := false
+	redirect := ""
+	pref := self.GetReadPreference()
+	read_replica := pref != ReadMaster && IsReadOnlyCommand(cmd, args...)
 	for {
 		if ttl <= 0 {
 			break
 		}
 		ttl -= 1
-		if key == "" {
-			panic(errors.New("no way to dispatch this type of command to redis cluster"))
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 		slot := self.SlotForKey(key)
 
 		var redis *RedisHandle
+		from_replica := false
 
-		if self.Debug {
-			fmt.Println("[RedisCluster] slot: ", slot, "key", key, "ttl", ttl)
-		}
+		self.log().Debug("Dispatching", "command", cmd, "key", key, "slot", slot, "ttl", ttl)
 
 		if try_random_node {
-			if self.Debug {
-				fmt.Println("[RedisCluster] Trying Random Node")
-			}
+			self.log().Debug("Trying Random Node", "command", cmd, "slot", slot)
 			redis = self.RandomRedisHandle()
 			try_random_node = false
+		} else if redirect != "" {
+			self.log().Debug("Trying Redirected Node", "command", cmd, "slot", slot, "node", redirect)
+			redis = self.handleForAddr(redirect)
+			redirect = ""
 		} else {
-			if self.Debug {
-				fmt.Println("[RedisCluster] Trying Specific Node")
+			self.log().Debug("Trying Specific Node", "command", cmd, "slot", slot)
+			if read_replica {
+				var err error
+				redis, err = self.readerForSlot(self.loadTable(), slot, pref)
+				if err != nil {
+					return nil, err
+				}
+				from_replica = redis != nil
 			}
-			redis = self.RedisHandleForSlot(slot)
-		}
-
-		if redis == nil {
-			if self.Debug {
-				fmt.Println("[RedisCluster] could not get redis handle, bailing this round")
+			if redis == nil {
+				redis = self.RedisHandleForSlot(slot)
 			}
-			break
-		}
-		if self.Debug {
-			fmt.Println("[RedisCluster] Got addr: ", redis.Addr)
 		}
 
-		if asking {
-			if self.Debug {
-				fmt.Println("ASKING")
-			}
-			//	conn := redis.GetRedisConn()
-			redis.Do("ASKING")
-			//	conn.Close()
-			asking = false
+		if redis == nil {
+			self.log().Error("could not get redis handle", "command", cmd, "slot", slot)
+			return nil, ErrNoHandle
 		}
+		self.log().Debug("Got addr", "command", cmd, "slot", slot, "node", redis.Addr)
+		info.Addr, info.Slot = redis.Addr, int(slot)
 
 		var err error
 		var resp interface{}
 
 		if flush {
-			resp, err = redis.Do(cmd, args...)
-			if err == nil {
-				if self.Debug {
-					fmt.Println("[RedisCluster] Success")
-				}
-				return resp, nil
+			if asking {
+				self.log().Debug("ASKING", "command", cmd, "slot", slot, "node", redis.Addr)
+				resp, err = self.askingDo(ctx, redis, cmd, args...)
+				asking = false
+			} else {
+				resp, err = redis.DoContext(ctx, cmd, args...)
 			}
-		} /*else {
-			err = redis.Send(cmd, args...)
 			if err == nil {
-				if self.Debug {
-					fmt.Println("[RedisCluster] Success")
-				}
-				return nil, nil
+				self.log().Debug("Success", "command", cmd, "slot", slot, "node", redis.Addr)
+				return resp, nil
 			}
-		}*/
+		}
 
 		// ok we are here so err is not nil
+		last_err = err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if strings.HasPrefix(err.Error(), "CROSSSLOT") {
+			return nil, fmt.Errorf("%w: %v", ErrCrossSlot, err)
+		}
 		errv := strings.Split(err.Error(), " ")
-		if errv[0] == "MOVED" || errv[0] == "ASK" {
+		if (errv[0] == "MOVED" || errv[0] == "ASK") && len(errv) == 3 {
+			redirect = errv[2]
+			info.Redirects++
 			if errv[0] == "ASK" {
-				if self.Debug {
-					fmt.Println("[RedisCluster] ASK")
-				}
+				self.log().Debug("Redirected", "command", cmd, "slot", slot, "node", redis.Addr, "redirect", "ASK", "to", redirect)
 				asking = true
 			} else {
-				// Serve replied with MOVED. It's better for us to
-				// ask for CLUSTER NODES the next time.
-				SetRefreshNeeded()
-				newslot, _ := strconv.Atoi(errv[1])
-				newaddr := errv[2]
-				slotsMap := make(map[uint16]string)
-				for k, v := range self.Slots {
-					slotsMap[k] = v
-				}
-				slotsMap[uint16(newslot)] = newaddr
-				self.Slots = slotsMap
-				if self.Debug {
-					fmt.Println("[RedisCluster] MOVED newaddr: ", newaddr, "new slot: ", newslot, "my slots len: ", len(self.Slots))
-				}
+				// Server replied with MOVED. Route the slot to the node
+				// now, and refresh the table once, however many requests
+				// got redirected.
+				self.log().Debug("Redirected", "command", cmd, "slot", slot, "node", redis.Addr, "redirect", "MOVED", "to", redirect)
+				self.updateSlot(slot, redirect)
+				self.scheduleRefresh(table)
 			}
-		} else {
-			if self.Debug {
-				fmt.Println("[RedisCluster] Other Error: ", err.Error())
+		} else if isCommandError(err) {
+			// the answer of the command, such as NOSCRIPT or WRONGTYPE,
+			// which any node would give as well
+			return nil, err
+		} else if from_replica {
+			self.log().Debug("Replica Error", "command", cmd, "slot", slot, "node", redis.Addr, "error", err)
+			if pref == ReadReplicaOnly {
+				return nil, err
 			}
+			// fall back to the master
+			read_replica = false
+		} else {
+			self.log().Debug("Other Error", "command", cmd, "slot", slot, "node", redis.Addr, "error", err)
 			try_random_node = true
 		}
 	}
-	if self.Debug {
-		fmt.Println("[RedisCluster] Failed Command")
+	if ok, suppressed := self.failLimit.allow(time.Second); ok {
+		self.log().Warn("Failed Command", "command", cmd, "key", key, "error", last_err, "suppressed", suppressed)
 	}
-	return nil, errors.New("could not complete command")
+	return nil, fmt.Errorf("%w: %v", ErrTooManyRedirects, last_err)
 }
 
-//func (self *RedisCluster) Send(cmd string, args ...interface{}) (err error) {
-//	_, err = self.SendClusterCommand(false, cmd, args...)
-//	return err
-//}
+// Whether the error is a reply of the server to the command, which another
+// node would give as well. The redirections and the transient cluster
+// states are not.
+func isCommandError(err error) bool {
+	if _, ok := err.(redis.Error); !ok {
+		return false
+	}
+	switch strings.SplitN(err.Error(), " ", 2)[0] {
+	case "MOVED", "ASK", "TRYAGAIN", "CLUSTERDOWN", "LOADING", "MASTERDOWN":
+		return false
+	}
+	return true
+}
 
 func (self *RedisCluster) SetRefreshNeeded() {
-	self.RefreshTableASAP = true
+	atomic.StoreInt32(&self.refreshNeeded, 1)
 }
 
 func (self *RedisCluster) HandleForKey(key string) *RedisHandle {
 	// forward onto first redis in the handle
 	// if we are set to single mode
-	if self.SingleRedisMode == true {
-		for _, handle := range self.Handles {
+	table := self.loadTable()
+	if table.single == true {
+		for _, handle := range table.handles {
 			return handle
 		}
 	}
@@ -475,16 +884,12 @@ type RedisClusterAccess interface {
 	HandleForKey(key string) *RedisHandle
 }
 
-var Instance RedisCluster
+var Instance = new(RedisCluster)
 
 func Do(commandName string, args ...interface{}) (reply interface{}, err error) {
 	return Instance.Do(commandName, args...)
 }
 
-//func Send(cmd string, args ...interface{}) (err error) {
-//	return Instance.Send(cmd, args...)
-//}
-
 func SetRefreshNeeded() {
 	Instance.SetRefreshNeeded()
 }
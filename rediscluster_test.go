@@ -1,11 +1,21 @@
 package goredis
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 var (
-	_testCluster RedisCluster = NewRedisCluster(
+	_testCluster *RedisCluster = NewRedisCluster(
 		[]string{
 			"127.0.0.1:7000",
 			"127.0.0.1:7001",
@@ -78,3 +88,352 @@ func TestClusterGetHandle(t *testing.T) {
 		}
 	}
 }
+
+func TestHashSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		tag  string
+		slot uint16
+	}{
+		{"123456789", "123456789", 12739},
+		{"foo", "foo", 12182},
+		{"bar", "bar", 5061},
+		{"hello", "hello", 866},
+		{"user1000", "user1000", 3443},
+		{"{user1000}.following", "user1000", 3443},
+		{"{user1000}.followers", "user1000", 3443},
+		{"foo{}{bar}", "foo{}{bar}", 8363},
+		{"foo{{bar}}zap", "{bar", 4015},
+		{"foo{bar}{zap}", "bar", 5061},
+		{"{}", "{}", 15257},
+		{"", "", 0},
+	}
+	for _, tt := range tests {
+		if tag := HashTag(tt.key); tag != tt.tag {
+			t.Errorf("HashTag(%q)=%q, want %q", tt.key, tag, tt.tag)
+		}
+		if slot := HashSlot(tt.key); slot != tt.slot {
+			t.Errorf("HashSlot(%q)=%d, want %d", tt.key, slot, tt.slot)
+		}
+		if slot := _testCluster.SlotForKey(tt.key); slot != tt.slot {
+			t.Errorf("SlotForKey(%q)=%d, want %d", tt.key, slot, tt.slot)
+		}
+	}
+}
+
+func TestClusterConcurrentDo(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs()[:1], 8, 128, false)
+	defer cluster.Close()
+
+	done := make(chan struct{})
+	var reshard sync.WaitGroup
+	reshard.Add(1)
+	go func() {
+		defer reshard.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			fc.move(0, 5000, i%3)
+			if i%4 == 0 {
+				cluster.SetRefreshNeeded()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for g := 0; g < 64; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key:%d:%d", g, i)
+				if _, err := cluster.Do("SET", key, i); err != nil {
+					errs <- err
+					return
+				}
+				rp, err := cluster.Do("GET", key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(rp.([]byte)) != fmt.Sprint(i) {
+					errs <- fmt.Errorf("GET %s=%s", key, rp)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(done)
+	reshard.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestClusterRefreshSingleFlight(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 128, false)
+	defer cluster.Close()
+	refreshes := fc.count("CLUSTER SLOTS")
+
+	// every key of node 0 is now served by node 1
+	fc.move(0, 5461, 1)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 100; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			<-start
+			// pick a key of node 0
+			key := fmt.Sprint(g)
+			for i := 0; HashSlot(key) > 5461; i++ {
+				key = fmt.Sprint(g, ":", i)
+			}
+			if _, err := cluster.Do("GET", key); err != nil {
+				t.Error(err)
+			}
+		}(g)
+	}
+	close(start)
+	wg.Wait()
+	for atomic.LoadInt32(&cluster.refreshing) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := fc.count("CLUSTER SLOTS") - refreshes; n != 1 {
+		t.Fatal("CLUSTER SLOTS called", n, "times")
+	}
+}
+
+func TestClusterMovedRefresh(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	cluster.SetMinRefreshInterval(time.Second)
+	if _, err := cluster.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	refreshes := fc.count("CLUSTER SLOTS")
+
+	slot := HashSlot("foo")
+	owner := fc.ownerOf(slot)
+	target := (owner + 1) % 3
+	fc.move(int(slot), int(slot), target)
+	for i := 0; i < 3; i++ {
+		if v, err := redis.String(cluster.Do("GET", "foo")); err != nil || v != "bar" {
+			t.Fatal(v, err)
+		}
+	}
+	// the slot follows the redirection at once, the refresh waits
+	handles := cluster.loadTable().handles
+	if n := fc.nodes[owner].count("GET"); n != 1 {
+		t.Error("GET sent", n, "times to the previous owner")
+	}
+	if n := fc.count("CLUSTER SLOTS") - refreshes; n != 0 {
+		t.Error("refreshed", n, "times within the minimum interval")
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for fc.count("CLUSTER SLOTS") == refreshes {
+		if time.Now().After(deadline) {
+			t.Fatal("no refresh after MOVED")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for atomic.LoadInt32(&cluster.refreshing) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the pools of the nodes are kept
+	for addr, handle := range handles {
+		if cluster.loadTable().handles[addr] != handle {
+			t.Error("pool of", addr, "replaced")
+		}
+	}
+}
+
+func TestClusterPeriodicRefresh(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	refreshes := fc.count("CLUSTER SLOTS")
+
+	// the table follows the resharding without any redirection
+	slot := HashSlot("foo")
+	owner := fc.ownerOf(slot)
+	fc.move(int(slot), int(slot), (owner+1)%3)
+	cluster.SetRefreshInterval(20 * time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for fc.count("CLUSTER SLOTS")-refreshes < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("no periodic refresh")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cluster.Do("GET", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fc.nodes[owner].count("GET"); n != 0 {
+		t.Error("GET sent", n, "times to the previous owner")
+	}
+
+	cluster.SetRefreshInterval(0)
+	time.Sleep(30 * time.Millisecond)
+	refreshes = fc.count("CLUSTER SLOTS")
+	time.Sleep(60 * time.Millisecond)
+	if n := fc.count("CLUSTER SLOTS") - refreshes; n != 0 {
+		t.Error("refreshed", n, "times after stopping")
+	}
+}
+
+func TestClusterStats(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	fc.addReplica(0)
+	cluster := NewRedisCluster(fc.addrs()[:1], 8, 8, false)
+	defer cluster.Close()
+	cluster.SetReadPreference(ReadPreferReplica)
+
+	for i := 0; i < 30; i++ {
+		if _, err := cluster.Do("GET", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := cluster.Stats()
+	if len(stats) != 4 {
+		t.Fatal("nodes:", len(stats))
+	}
+	var total PoolStats
+	for _, s := range stats {
+		total = total.Add(s)
+	}
+	if total.Dials == 0 || total.Dials != int64(total.Active) || total.DialErrors != 0 {
+		t.Errorf("total: %+v", total)
+	}
+	if replica := fc.nodes[3].addr; stats[replica].Dials == 0 {
+		t.Errorf("replica: %+v", stats[replica])
+	}
+}
+
+func TestClusterErrors(t *testing.T) {
+	// cluster support disabled on several seeds
+	var servers []*fakeServer
+	for i := 0; i < 2; i++ {
+		server := newFakeServer(func(c *fakeConn, args []string) interface{} {
+			return errors.New("ERR This instance has cluster support disabled")
+		})
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	cluster, err := DialCluster([]string{servers[0].addr, servers[1].addr}, 8, 8, false)
+	if !errors.Is(err, ErrClusterDisabled) {
+		t.Fatal("dial:", err)
+	}
+	if _, err := cluster.Do("GET", "foo"); !errors.Is(err, ErrClusterDisabled) {
+		t.Error("do:", err)
+	}
+	cluster.Close()
+
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster, err = DialCluster(fc.addrs(), 8, 8, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	if _, err := cluster.Do("MULTI"); !errors.Is(err, ErrNoKey) {
+		t.Error("keyless:", err)
+	}
+	if _, err := cluster.Do("RENAME", "{a}", "{b}"); !errors.Is(err, ErrCrossSlot) {
+		t.Error("cross slot:", err)
+	}
+	// the error of the command is returned as is, without a retry
+	if _, err := cluster.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cluster.Do("INCR", "foo")
+	if _, ok := err.(redis.Error); !ok || errors.Is(err, ErrTooManyRedirects) {
+		t.Error("command error:", err)
+	}
+	if n := fc.count("INCR"); n != 1 {
+		t.Error("INCR sent", n, "times")
+	}
+
+	// a node redirecting to itself forever
+	var addr string
+	loop := newFakeServer(func(c *fakeConn, args []string) interface{} {
+		if strings.ToUpper(args[0]) == "CLUSTER" {
+			// serving every slot
+			host, port, _ := net.SplitHostPort(addr)
+			n, _ := strconv.Atoi(port)
+			return []interface{}{[]interface{}{0, 16383, []interface{}{host, n}}}
+		}
+		return fmt.Errorf("MOVED %d %s", HashSlot(args[1]), addr)
+	})
+	defer loop.Close()
+	addr = loop.addr
+	cluster, err = DialCluster([]string{addr}, 8, 8, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	if _, err := cluster.Do("GET", "foo"); !errors.Is(err, ErrTooManyRedirects) {
+		t.Error("redirects:", err)
+	}
+}
+
+func TestClusterAsk(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	if _, err := cluster.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	slot := HashSlot("foo")
+	target := (fc.ownerOf(slot) + 1) % 3
+	fc.migrate(int(slot), target)
+
+	// several idle connections to the target, ASKING on one of them
+	// doesn't hold for the next command of the pool
+	handle := cluster.handleForAddr(fc.nodes[target].addr)
+	conns := []*RedisConn{handle.Get(), handle.Get(), handle.Get()}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	for i := 0; i < 3; i++ {
+		if v, err := redis.String(cluster.Do("GET", "foo")); err != nil || v != "bar" {
+			t.Fatal(v, err)
+		}
+	}
+	if n := fc.nodes[target].count("ASKING"); n != 3 {
+		t.Error("ASKING sent", n, "times")
+	}
+	if n := fc.nodes[target].count("GET"); n != 3 {
+		t.Error("GET sent", n, "times to the target")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cluster.Do("GET", "foo"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -2,34 +2,253 @@ package goredis
 
 import "github.com/garyburd/redigo/redis"
 import "os"
-import "fmt"
+import "net"
+import "context"
+import "time"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
 
+// RedisHandle is the Client of a standalone node, or of one node of a
+// cluster. Its pool is internal: the setters tune it, Stats and NodeStats
+// give its state.
 type RedisHandle struct {
 	Addr string
-	*Pool
+	pool *Pool
 }
 
-// XXX: add some password protection
-func NewRedisHandle(addr string, max_idle, max_active int, debug bool) *RedisHandle {
-	if debug {
-		fmt.Println("[RedisHandle] Opening New Handle For Pid:", os.Getpid())
+// The settings applied to every connection a RedisHandle opens.
+type DialOptions struct {
+	// "tcp" when empty, or "unix" for an address which is the path of a
+	// socket
+	Network string
+	// AUTH with the password, as the ACL user if Username is set
+	Username string
+	Password string
+	// SELECT the database, standalone servers only: a cluster has only
+	// the database 0 and RedisCluster ignores it
+	Database int
+	// CLIENT SETNAME
+	ClientName string
+
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	KeepAlive      time.Duration
+
+	// Talk TLS when set. Without a ServerName, the certificate of every
+	// node is verified against the host of its address.
+	TLSConfig *tls.Config
+}
+
+// Return a TLS configuration trusting the certificates of the CA bundle,
+// or the system ones if caFile is empty, and presenting the client
+// certificate if certFile and keyFile are set. Set ServerName or
+// InsecureSkipVerify on the result as needed.
+func NewTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
 	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func NewRedisHandle(addr string, max_idle, max_active int, debug bool) *RedisHandle {
+	return newRedisHandle(addr, max_idle, max_active, debug, false, DialOptions{})
+}
+
+func NewRedisHandleWithOptions(addr string, max_idle, max_active int, debug bool, options DialOptions) *RedisHandle {
+	return newRedisHandle(addr, max_idle, max_active, debug, false, options)
+}
+
+// With readonly, every connection is switched to READONLY mode so that a
+// cluster replica serves the reads of the slots of its master.
+func newRedisHandle(addr string, max_idle, max_active int, debug, readonly bool, options DialOptions) *RedisHandle {
 	rh := &RedisHandle{
 		Addr: addr,
-		Pool: NewPool(func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", addr)
+		pool: NewPoolContext(func(ctx context.Context) (redis.Conn, error) {
+			c, err := options.dial(ctx, addr)
 			if err != nil {
 				return nil, err
 			}
+			if readonly {
+				if _, err := c.Do("READONLY"); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
 			return c, nil
 		},
 			int32(max_idle),
 			int32(max_active)),
 	}
+	rh.pool.addr = addr
+	rh.SetLogger(LoggerWith(stdLogger{prefix: "[RedisHandle] ", debug: debug}, "node", addr))
+	rh.pool.log().Debug("Opening New Handle", "pid", os.Getpid())
 
 	return rh
 }
 
+// The methods of the pool of the handle, see Pool.
+
+func (self *RedisHandle) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return self.pool.Do(cmd, args...)
+}
+
+func (self *RedisHandle) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return self.pool.DoContext(ctx, cmd, args...)
+}
+
+func (self *RedisHandle) Pipeline(commands Commands) ([]*RedisReply, error) {
+	return self.pool.Pipeline(commands)
+}
+
+// Return a connection, to give back with Close.
+func (self *RedisHandle) Get() *RedisConn {
+	return self.pool.Get()
+}
+
+func (self *RedisHandle) GetContext(ctx context.Context) *RedisConn {
+	return self.pool.GetContext(ctx)
+}
+
+func (self *RedisHandle) Tx() *Tx {
+	return self.pool.Tx()
+}
+
+func (self *RedisHandle) Watch(fn func(tx *Tx) error, keys ...string) ([]*RedisReply, error) {
+	return self.pool.Watch(fn, keys...)
+}
+
+func (self *RedisHandle) PubSub() *PubSub {
+	return self.pool.PubSub()
+}
+
+func (self *RedisHandle) Scan(match string, count int, typ string) *ScanIterator {
+	return self.pool.Scan(match, count, typ)
+}
+
+func (self *RedisHandle) Stats() PoolStats {
+	return self.pool.Stats()
+}
+
+func (self *RedisHandle) NodeStats() map[string]PoolStats {
+	return self.pool.NodeStats()
+}
+
+func (self *RedisHandle) SetLogger(logger Logger) {
+	self.pool.SetLogger(logger)
+}
+
+func (self *RedisHandle) AddHook(hook Hook) {
+	self.pool.AddHook(hook)
+}
+
+func (self *RedisHandle) Update(maxIdle, maxActive int32) {
+	self.pool.Update(maxIdle, maxActive)
+}
+
+func (self *RedisHandle) SetWaitTime(d int) {
+	self.pool.SetWaitTime(d)
+}
+
+func (self *RedisHandle) SetLifeTime(d int) {
+	self.pool.SetLifeTime(d)
+}
+
+func (self *RedisHandle) SetPingTime(d int) {
+	self.pool.SetPingTime(d)
+}
+
+func (self *RedisHandle) TestConn() error {
+	return self.pool.TestConn()
+}
+
+func (self *RedisHandle) Close() {
+	self.pool.Close()
+}
+
+// Dial addr and set the connection up.
+func (options DialOptions) dial(ctx context.Context, addr string) (redis.Conn, error) {
+	dialer := net.Dialer{
+		Timeout:   options.ConnectTimeout,
+		KeepAlive: options.KeepAlive,
+	}
+	network := options.Network
+	if network == "" {
+		network = "tcp"
+	}
+	c, err := redis.Dial(network, addr,
+		redis.DialReadTimeout(options.ReadTimeout),
+		redis.DialWriteTimeout(options.WriteTimeout),
+		redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || options.TLSConfig == nil {
+				return conn, err
+			}
+			return options.handshake(ctx, conn, addr)
+		}))
+	if err != nil {
+		return nil, err
+	}
+	if options.Password != "" {
+		if options.Username != "" {
+			_, err = c.Do("AUTH", options.Username, options.Password)
+		} else {
+			_, err = c.Do("AUTH", options.Password)
+		}
+	}
+	if err == nil && options.Database != 0 {
+		_, err = c.Do("SELECT", options.Database)
+	}
+	if err == nil && options.ClientName != "" {
+		_, err = c.Do("CLIENT", "SETNAME", options.ClientName)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Start TLS on the connection to addr.
+func (options DialOptions) handshake(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	config := options.TLSConfig.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	if options.ConnectTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.ConnectTimeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
 // XXX: is _not_ calling defer rc.Close()
 //      so do it yourself later
 //func (self *RedisHandle) Send(cmd string, args ...interface{}) (err error) {
@@ -0,0 +1,140 @@
+package goredis
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRedisHandleDialOptions(t *testing.T) {
+	store := newFakeStore()
+	store.username, store.password = "app", "secret"
+	var (
+		server *fakeServer
+		conns  []*fakeConn
+	)
+	server = newFakeServer(func(c *fakeConn, args []string) interface{} {
+		server.mutex.Lock()
+		conns = append(conns, c)
+		server.mutex.Unlock()
+		return store.doConn(c, args)
+	})
+	defer server.Close()
+
+	handle := NewRedisHandle(server.addr, 4, 4, false)
+	if _, err := handle.Do("GET", "foo"); err == nil || !strings.HasPrefix(err.Error(), "NOAUTH") {
+		t.Error("no auth:", err)
+	}
+	handle.Close()
+
+	handle = NewRedisHandleWithOptions(server.addr, 4, 4, false, DialOptions{
+		Username:       "app",
+		Password:       "secret",
+		Database:       3,
+		ClientName:     "worker",
+		ConnectTimeout: time.Second,
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+		KeepAlive:      time.Minute,
+	})
+	defer handle.Close()
+	if _, err := handle.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := redis.String(handle.Do("CLIENT", "GETNAME")); err != nil || name != "worker" {
+		t.Error("name:", name, err)
+	}
+	server.mutex.Lock()
+	c := conns[len(conns)-1]
+	server.mutex.Unlock()
+	if !c.authed || c.db != 3 {
+		t.Errorf("authed: %v, db: %d", c.authed, c.db)
+	}
+
+	// wrong password, the dial fails
+	bad := NewRedisHandleWithOptions(server.addr, 4, 4, false, DialOptions{Username: "app", Password: "nope"})
+	defer bad.Close()
+	if _, err := bad.Do("GET", "foo"); err == nil || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+		t.Error("wrong password:", err)
+	}
+}
+
+func TestClusterDialOptions(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	fc.store.username, fc.store.password = "app", "secret"
+
+	options := DialOptions{Username: "app", Password: "secret", Database: 3, ClientName: "worker"}
+	cluster, err := DialClusterWithOptions(fc.addrs()[:1], 8, 8, false, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	if len(cluster.Topology().Masters) != 3 {
+		t.Fatal("masters:", len(cluster.Topology().Masters))
+	}
+	// the nodes found by the refresh get the options too, but no SELECT
+	for i := 0; i < 30; i++ {
+		if _, err := cluster.Do("SET", i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, node := range fc.nodes {
+		if node.count("AUTH") == 0 || node.count("CLIENT SETNAME") == 0 {
+			t.Error("node", i, "not set up")
+		}
+	}
+	if n := fc.count("SELECT"); n != 0 {
+		t.Error("SELECT sent to the cluster", n, "times")
+	}
+}
+
+func TestSingleDialOptions(t *testing.T) {
+	store := newFakeStore()
+	server := newFakeServer(func(c *fakeConn, args []string) interface{} {
+		if strings.ToUpper(args[0]) == "CLUSTER" {
+			return errors.New("ERR This instance has cluster support disabled")
+		}
+		return store.doConn(c, args)
+	})
+	defer server.Close()
+
+	cluster, err := DialClusterWithOptions([]string{server.addr}, 8, 8, false, DialOptions{Database: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	if _, err := cluster.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.count("SELECT"); n == 0 {
+		t.Error("database not selected in single mode")
+	}
+}
+
+func TestRedisHandlePool(t *testing.T) {
+	server := newFakeServer(newFakeStore().doConn)
+	defer server.Close()
+	handle := NewRedisHandle(server.addr, 4, 4, false)
+	defer handle.Close()
+	handle.SetLifeTime(10)
+	handle.SetPingTime(2)
+	if err := handle.TestConn(); err != nil {
+		t.Fatal(err)
+	}
+
+	// one connection, taken: the next Get gives up after the wait time
+	handle.Update(1, 1)
+	handle.SetWaitTime(1)
+	conn := handle.Get()
+	defer conn.Close()
+	if err := handle.Get().Err(); err == nil {
+		t.Error("no timeout")
+	}
+	if stats := handle.Stats(); stats.Timeouts != 1 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
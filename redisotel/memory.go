@@ -0,0 +1,126 @@
+package redisotel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A span ended, as kept by InMemoryExporter.
+type SpanData struct {
+	Name       string
+	Attributes map[string]interface{}
+	Errors     []error
+	Start      time.Time
+	End        time.Time
+	Parent     *SpanData
+}
+
+// A value recorded, as kept by InMemoryExporter.
+type Measurement struct {
+	Name       string
+	Value      float64
+	Attributes map[string]interface{}
+	Gauge      bool
+}
+
+// A Tracer and a Meter keeping the spans and the measurements in memory,
+// for the tests.
+type InMemoryExporter struct {
+	mutex        sync.Mutex
+	spans        []*SpanData
+	measurements []Measurement
+}
+
+var (
+	_ Tracer = (*InMemoryExporter)(nil)
+	_ Meter  = (*InMemoryExporter)(nil)
+)
+
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+type memorySpanKey struct{}
+
+type memorySpan struct {
+	exporter *InMemoryExporter
+	data     *SpanData
+}
+
+func (e *InMemoryExporter) Start(ctx context.Context, name string) (context.Context, Span) {
+	data := &SpanData{Name: name, Attributes: make(map[string]interface{}), Start: time.Now()}
+	if parent, ok := ctx.Value(memorySpanKey{}).(*SpanData); ok {
+		data.Parent = parent
+	}
+	return context.WithValue(ctx, memorySpanKey{}, data), &memorySpan{e, data}
+}
+
+func (s *memorySpan) SetAttributes(attrs ...Attribute) {
+	s.exporter.mutex.Lock()
+	defer s.exporter.mutex.Unlock()
+	for _, attr := range attrs {
+		s.data.Attributes[attr.Key] = attr.Value
+	}
+}
+
+func (s *memorySpan) RecordError(err error) {
+	s.exporter.mutex.Lock()
+	defer s.exporter.mutex.Unlock()
+	s.data.Errors = append(s.data.Errors, err)
+}
+
+func (s *memorySpan) End() {
+	s.exporter.mutex.Lock()
+	defer s.exporter.mutex.Unlock()
+	s.data.End = time.Now()
+	s.exporter.spans = append(s.exporter.spans, s.data)
+}
+
+func (e *InMemoryExporter) Record(ctx context.Context, name string, value float64, attrs ...Attribute) {
+	e.measure(name, value, attrs, false)
+}
+
+func (e *InMemoryExporter) Gauge(ctx context.Context, name string, value int64, attrs ...Attribute) {
+	e.measure(name, float64(value), attrs, true)
+}
+
+func (e *InMemoryExporter) measure(name string, value float64, attrs []Attribute, gauge bool) {
+	m := Measurement{Name: name, Value: value, Attributes: make(map[string]interface{}), Gauge: gauge}
+	for _, attr := range attrs {
+		m.Attributes[attr.Key] = attr.Value
+	}
+	e.mutex.Lock()
+	e.measurements = append(e.measurements, m)
+	e.mutex.Unlock()
+}
+
+// Return the spans ended, in order.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	spans := make([]SpanData, len(e.spans))
+	for i, span := range e.spans {
+		spans[i] = *span
+	}
+	return spans
+}
+
+// Return the measurements of the metric, in order.
+func (e *InMemoryExporter) Measurements(name string) []Measurement {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var found []Measurement
+	for _, m := range e.measurements {
+		if m.Name == name {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+func (e *InMemoryExporter) Reset() {
+	e.mutex.Lock()
+	e.spans, e.measurements = nil, nil
+	e.mutex.Unlock()
+}
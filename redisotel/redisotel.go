@@ -0,0 +1,232 @@
+// Package redisotel traces the commands of goredis and records their
+// metrics, with the span and attribute conventions of OpenTelemetry.
+//
+// The package only depends on goredis, it ships no OpenTelemetry adapter.
+// Tracer, Span and Meter are the few methods it needs: implement them on
+// top of an OpenTelemetry trace.Tracer and metric.Meter, converting the
+// Attributes to attribute.KeyValue, or any other backend.
+// InMemoryExporter implements them and records everything for the tests.
+package redisotel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jettyu/goredis"
+)
+
+// The attribute keys.
+const (
+	DBSystem       = "db.system"
+	DBOperation    = "db.operation"
+	DBStatement    = "db.statement"
+	NetPeerName    = "net.peer.name"
+	NetPeerPort    = "net.peer.port"
+	ClusterSlot    = "db.redis.cluster.slot"
+	Redirects      = "db.redis.redirects"
+	PipelineLength = "db.redis.pipeline.length"
+	ConnState      = "state"
+)
+
+// The metric names.
+const (
+	OperationDuration = "db.client.operation.duration" // histogram, seconds
+	DialDuration      = "db.client.connections.create_time"
+	ConnUsage         = "db.client.connections.usage" // gauge, by ConnState
+	ConnWaits         = "db.client.connections.waits"
+	ConnTimeouts      = "db.client.connections.timeouts"
+	ConnDials         = "db.client.connections.dials"
+	ConnDialErrors    = "db.client.connections.dial_errors"
+)
+
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Attribute  { return Attribute{key, value} }
+func Int(key string, value int) Attribute { return Attribute{key, value} }
+
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Meter interface {
+	// Record a value of a histogram.
+	Record(ctx context.Context, name string, value float64, attrs ...Attribute)
+	// Set the current value of a gauge.
+	Gauge(ctx context.Context, name string, value int64, attrs ...Attribute)
+}
+
+// Return the db.statement of a command.
+type StatementFunc func(name string, args []interface{}) string
+
+// The default StatementFunc: the command with its arguments replaced by
+// "?", the values may be secrets or personal data.
+func RedactArgs(name string, args []interface{}) string {
+	return name + strings.Repeat(" ?", len(args))
+}
+
+// A StatementFunc keeping the arguments, for the tests or the trusted
+// environments.
+func FullStatement(name string, args []interface{}) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, arg := range args {
+		fmt.Fprintf(&b, " %v", arg)
+	}
+	return b.String()
+}
+
+type Config struct {
+	Tracer    Tracer // no spans if nil
+	Meter     Meter  // no metrics if nil
+	Statement StatementFunc
+}
+
+// A goredis.Hook tracing and measuring the commands, pipelines and dials.
+// Add it to a Pool, a RedisHandle or a RedisCluster.
+type Hook struct {
+	config Config
+}
+
+var _ goredis.Hook = (*Hook)(nil)
+
+func NewHook(config Config) *Hook {
+	if config.Statement == nil {
+		config.Statement = RedactArgs
+	}
+	return &Hook{config: config}
+}
+
+type spanKey struct{}
+
+func (h *Hook) start(ctx context.Context, name string, attrs []Attribute) context.Context {
+	if h.config.Tracer == nil {
+		return ctx
+	}
+	ctx, span := h.config.Tracer.Start(ctx, name)
+	span.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func (h *Hook) end(ctx context.Context, attrs []Attribute, err error) {
+	span, ok := ctx.Value(spanKey{}).(Span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attrs...)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+func (h *Hook) record(ctx context.Context, name string, d time.Duration, attrs ...Attribute) {
+	if h.config.Meter != nil {
+		h.config.Meter.Record(ctx, name, d.Seconds(), attrs...)
+	}
+}
+
+func (h *Hook) BeforeProcess(ctx context.Context, cmd *goredis.CommandInfo) context.Context {
+	operation := strings.ToUpper(cmd.Name)
+	return h.start(ctx, operation, []Attribute{
+		String(DBSystem, "redis"),
+		String(DBOperation, operation),
+		String(DBStatement, h.config.Statement(operation, cmd.Args)),
+	})
+}
+
+func (h *Hook) AfterProcess(ctx context.Context, cmd *goredis.CommandInfo) {
+	attrs := peerAttributes(cmd.Addr)
+	if cmd.Slot >= 0 {
+		attrs = append(attrs, Int(ClusterSlot, cmd.Slot))
+	}
+	if cmd.Redirects > 0 {
+		attrs = append(attrs, Int(Redirects, cmd.Redirects))
+	}
+	h.end(ctx, attrs, replyError(cmd.Err))
+	h.record(ctx, OperationDuration, cmd.Duration,
+		String(DBSystem, "redis"), String(DBOperation, strings.ToUpper(cmd.Name)))
+}
+
+func (h *Hook) BeforePipeline(ctx context.Context, pipeline *goredis.PipelineInfo) context.Context {
+	statements := make([]string, len(pipeline.Commands))
+	for i, command := range pipeline.Commands {
+		statements[i] = h.config.Statement(strings.ToUpper(command.CommandName), command.Args)
+	}
+	return h.start(ctx, "PIPELINE", []Attribute{
+		String(DBSystem, "redis"),
+		String(DBOperation, "PIPELINE"),
+		String(DBStatement, strings.Join(statements, "\n")),
+		Int(PipelineLength, len(pipeline.Commands)),
+	})
+}
+
+func (h *Hook) AfterPipeline(ctx context.Context, pipeline *goredis.PipelineInfo) {
+	h.end(ctx, peerAttributes(pipeline.Addr), pipeline.Err)
+	h.record(ctx, OperationDuration, pipeline.Duration,
+		String(DBSystem, "redis"), String(DBOperation, "PIPELINE"))
+}
+
+func (h *Hook) BeforeDial(ctx context.Context, dial *goredis.DialInfo) context.Context {
+	return h.start(ctx, "redis.dial", append([]Attribute{String(DBSystem, "redis")}, peerAttributes(dial.Addr)...))
+}
+
+func (h *Hook) AfterDial(ctx context.Context, dial *goredis.DialInfo) {
+	h.end(ctx, nil, dial.Err)
+	h.record(ctx, DialDuration, dial.Duration, append([]Attribute{String(DBSystem, "redis")}, peerAttributes(dial.Addr)...)...)
+}
+
+// Record the gauges of the pools, by node, as given by the NodeStats of a
+// goredis.Client.
+// Call it periodically, or from the callback of an observable instrument.
+func RecordStats(ctx context.Context, meter Meter, stats map[string]goredis.PoolStats) {
+	for addr, s := range stats {
+		attrs := append([]Attribute{String(DBSystem, "redis")}, peerAttributes(addr)...)
+		attrs = attrs[:len(attrs):len(attrs)]
+		meter.Gauge(ctx, ConnUsage, int64(s.Idle), append(attrs, String(ConnState, "idle"))...)
+		meter.Gauge(ctx, ConnUsage, int64(s.Active-s.Idle), append(attrs, String(ConnState, "used"))...)
+		meter.Gauge(ctx, ConnWaits, s.Waits, attrs...)
+		meter.Gauge(ctx, ConnTimeouts, s.Timeouts, attrs...)
+		meter.Gauge(ctx, ConnDials, s.Dials, attrs...)
+		meter.Gauge(ctx, ConnDialErrors, s.DialErrors, attrs...)
+	}
+}
+
+// Record the gauges of a single pool.
+func RecordPoolStats(ctx context.Context, meter Meter, addr string, pool *goredis.Pool) {
+	RecordStats(ctx, meter, map[string]goredis.PoolStats{addr: pool.Stats()})
+}
+
+func peerAttributes(addr string) []Attribute {
+	if addr == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []Attribute{String(NetPeerName, addr)}
+	}
+	if n, err := strconv.Atoi(port); err == nil {
+		return []Attribute{String(NetPeerName, host), Int(NetPeerPort, n)}
+	}
+	return []Attribute{String(NetPeerName, host)}
+}
+
+// A nil reply isn't an error of the span.
+func replyError(err error) error {
+	if err == nil || err.Error() == "redigo: nil returned" {
+		return nil
+	}
+	return err
+}
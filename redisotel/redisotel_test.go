@@ -0,0 +1,146 @@
+package redisotel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jettyu/goredis"
+)
+
+// A server answering OK to every command, and an error to FAIL.
+func newOKServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveOK(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveOK(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		var name string
+		for i := 0; i < n; i++ {
+			r.ReadString('\n')
+			arg, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				name = strings.TrimSpace(arg)
+			}
+		}
+		if name == "FAIL" {
+			c.Write([]byte("-ERR failed\r\n"))
+		} else {
+			c.Write([]byte("+OK\r\n"))
+		}
+	}
+}
+
+func TestHookSpans(t *testing.T) {
+	addr := newOKServer(t)
+	handle := goredis.NewRedisHandle(addr, 4, 4, false)
+	defer handle.Close()
+	exporter := NewInMemoryExporter()
+	handle.AddHook(NewHook(Config{Tracer: exporter, Meter: exporter}))
+
+	if _, err := handle.Do("SET", "user:1", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handle.Do("FAIL"); err == nil {
+		t.Fatal("no error")
+	}
+	commands := goredis.Commands{}.Append(goredis.NewCommand("SET", "a", 1)).Append(goredis.NewCommand("GET", "a"))
+	if _, err := handle.Pipeline(commands); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("spans: %+v", spans)
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	dial, set, fail, pipeline := spans[0], spans[1], spans[2], spans[3]
+	if dial.Name != "redis.dial" || dial.Attributes[NetPeerName] != host || len(dial.Errors) != 0 {
+		t.Errorf("dial: %+v", dial)
+	}
+	if set.Name != "SET" || set.Attributes[DBSystem] != "redis" || set.Attributes[DBStatement] != "SET ? ?" ||
+		set.Attributes[NetPeerName] != host || fmt.Sprint(set.Attributes[NetPeerPort]) != port || len(set.Errors) != 0 {
+		t.Errorf("SET: %+v", set)
+	}
+	if _, ok := set.Attributes[ClusterSlot]; ok {
+		t.Error("slot outside of a cluster")
+	}
+	if fail.Name != "FAIL" || len(fail.Errors) != 1 {
+		t.Errorf("FAIL: %+v", fail)
+	}
+	if pipeline.Name != "PIPELINE" || pipeline.Attributes[PipelineLength] != 2 ||
+		pipeline.Attributes[DBStatement] != "SET ? ?\nGET ?" {
+		t.Errorf("PIPELINE: %+v", pipeline)
+	}
+
+	durations := exporter.Measurements(OperationDuration)
+	if len(durations) != 3 || durations[0].Attributes[DBOperation] != "SET" || durations[0].Value <= 0 {
+		t.Errorf("durations: %+v", durations)
+	}
+	if dials := exporter.Measurements(DialDuration); len(dials) != 1 {
+		t.Errorf("dials: %+v", dials)
+	}
+}
+
+func TestHookClusterAttributes(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	hook := NewHook(Config{Tracer: exporter, Statement: FullStatement})
+	info := &goredis.CommandInfo{Name: "get", Args: []interface{}{"foo"}, Addr: "10.0.0.1:7000", Slot: 12182, Redirects: 1}
+	ctx := hook.BeforeProcess(context.Background(), info)
+	info.Err = errors.New("redigo: nil returned")
+	hook.AfterProcess(ctx, info)
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("spans: %+v", spans)
+	}
+	span := spans[0]
+	if span.Name != "GET" || span.Attributes[DBStatement] != "GET foo" || span.Attributes[ClusterSlot] != 12182 ||
+		span.Attributes[Redirects] != 1 || span.Attributes[NetPeerName] != "10.0.0.1" || len(span.Errors) != 0 {
+		t.Errorf("span: %+v", span)
+	}
+}
+
+func TestRecordStats(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	RecordStats(context.Background(), exporter, map[string]goredis.PoolStats{
+		"10.0.0.1:7000": {Active: 5, Idle: 2, Waits: 3},
+	})
+	usage := exporter.Measurements(ConnUsage)
+	if len(usage) != 2 || usage[0].Value != 2 || usage[0].Attributes[ConnState] != "idle" ||
+		usage[1].Value != 3 || usage[1].Attributes[ConnState] != "used" || !usage[0].Gauge {
+		t.Errorf("usage: %+v", usage)
+	}
+	if waits := exporter.Measurements(ConnWaits); len(waits) != 1 || waits[0].Value != 3 {
+		t.Errorf("waits: %+v", waits)
+	}
+}
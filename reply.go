@@ -1,5 +1,7 @@
 package goredis
 
+import "github.com/garyburd/redigo/redis"
+
 const (
 	REDIS_REPLY_STRING  = 1
 	REDIS_REPLY_ARRAY   = 2
@@ -46,6 +48,14 @@ func NewRedisReply(re interface{}, err error) *RedisReply {
 	case int64:
 		reply.Type = REDIS_REPLY_INTEGER
 		reply.Integer = re.(int64)
+	case string:
+		reply.Type = REDIS_REPLY_STATUS
+		reply.Str = re.(string)
+		reply.Len = len(reply.Str)
+	case redis.Error:
+		reply.Type = REDIS_REPLY_ERROR
+		reply.Str = re.(redis.Error).Error()
+		reply.Len = len(reply.Str)
 	}
 	return reply
 }
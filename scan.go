@@ -0,0 +1,465 @@
+package goredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The topology kept changing while a cluster was scanned.
+var ErrScanUnstable = errors.New("cluster topology kept changing during the scan")
+
+// A node to scan, and the slots whose keys are kept, all if nil.
+type scanTask struct {
+	addr  string
+	pool  *Pool
+	slots map[uint16]bool
+	owned map[uint16]bool // served by the node when its scan started
+}
+
+// The slots scanned so far. A slot is covered once a node serving it
+// from the start to the end of its scan was scanned entirely. The slots
+// which moved or whose node failed are scanned again on their new node.
+type scanCoverage struct {
+	cluster *RedisCluster
+	mutex   sync.Mutex
+	covered map[uint16]bool
+	scanned []*scanTask // scanned entirely in the current round
+	rounds  int
+}
+
+// Return the tasks of the next round, none once every slot is covered.
+// The table is refreshed once at the end of every round, to learn which
+// slots stayed on the nodes scanned.
+func (c *scanCoverage) round() ([]*scanTask, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.rounds > 0 {
+		c.cluster.refreshTable(nil)
+	}
+	table := c.cluster.loadTable()
+	for _, task := range c.scanned {
+		owned := ownedSlots(table, task.addr)
+		for slot := range task.owned {
+			if owned[slot] && (task.slots == nil || task.slots[slot]) {
+				c.covered[slot] = true
+			}
+		}
+	}
+	c.scanned = nil
+	if c.rounds == 0 {
+		// every master, keeping all their keys, those of the slots being
+		// imported included
+		c.rounds++
+		var tasks []*scanTask
+		for _, addr := range masterAddrs(table) {
+			tasks = append(tasks, &scanTask{addr: addr})
+		}
+		return tasks, nil
+	}
+	byAddr := make(map[string]*scanTask)
+	for slot := 0; slot < RedisClusterHashSlots; slot++ {
+		if c.covered[uint16(slot)] {
+			continue
+		}
+		addr, ok := table.slots[uint16(slot)]
+		if !ok {
+			return nil, fmt.Errorf("%w: slot %d", ErrNoHandle, slot)
+		}
+		task, ok := byAddr[addr]
+		if !ok {
+			task = &scanTask{addr: addr, slots: make(map[uint16]bool)}
+			byAddr[addr] = task
+		}
+		task.slots[uint16(slot)] = true
+	}
+	if len(byAddr) == 0 {
+		return nil, nil
+	}
+	if c.rounds > RedisClusterRequestTTL {
+		return nil, ErrScanUnstable
+	}
+	c.rounds++
+	tasks := make([]*scanTask, 0, len(byAddr))
+	for _, task := range byAddr {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].addr < tasks[j].addr })
+	return tasks, nil
+}
+
+func (c *scanCoverage) start(task *scanTask) {
+	task.pool = c.cluster.handleForAddr(task.addr).pool
+	task.owned = ownedSlots(c.cluster.loadTable(), task.addr)
+}
+
+// The node was scanned entirely, the slots it still serves at the end of
+// the round are covered.
+func (c *scanCoverage) finish(task *scanTask) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.scanned = append(c.scanned, task)
+}
+
+// The node failed, its slots will be scanned on the nodes taking over.
+func (c *scanCoverage) fail(task *scanTask, err error) {
+	c.cluster.log().Warn("Scan failed", "node", task.addr, "error", err)
+}
+
+// ScanIterator walks the keys of a SCAN, on every master of a cluster. A
+// key may be returned more than once, as with SCAN itself.
+//
+//	it := cluster.Scan("user:*", 100, "")
+//	for it.Next() {
+//		fmt.Println(it.Key())
+//	}
+//	if err := it.Err(); err != nil {
+type ScanIterator struct {
+	args     []interface{} // MATCH, COUNT and TYPE
+	coverage *scanCoverage // nil on a single node
+	tasks    []*scanTask
+	task     *scanTask
+	cursor   string
+	keys     []string
+	key      string
+	err      error
+	done     bool
+}
+
+func scanArgs(match string, count int, typ string) []interface{} {
+	var args []interface{}
+	if match != "" {
+		args = append(args, "MATCH", match)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	if typ != "" {
+		args = append(args, "TYPE", typ)
+	}
+	return args
+}
+
+// Iterate over the keys matching the glob-style pattern match, of the
+// type typ, SCAN returning about count of them at a time. The empty
+// values and zero leave the options out.
+func (this *Pool) Scan(match string, count int, typ string) *ScanIterator {
+	return &ScanIterator{
+		args:  scanArgs(match, count, typ),
+		tasks: []*scanTask{{addr: this.addr, pool: this}},
+	}
+}
+
+// Same as Pool.Scan, on every master one after the other.
+func (self *RedisCluster) Scan(match string, count int, typ string) *ScanIterator {
+	it := &ScanIterator{args: scanArgs(match, count, typ), err: self.err}
+	table := self.loadTable()
+	if table.single {
+		for addr, handle := range table.handles {
+			it.tasks = append(it.tasks, &scanTask{addr: addr, pool: handle.pool})
+		}
+		return it
+	}
+	it.coverage = &scanCoverage{cluster: self, covered: make(map[uint16]bool)}
+	return it
+}
+
+// Same as Pool.Scan, on the current master.
+func (this *SentinelHandle) Scan(match string, count int, typ string) *ScanIterator {
+	handle, err := this.masterHandle(context.Background())
+	if err != nil {
+		return &ScanIterator{err: err}
+	}
+	return handle.Scan(match, count, typ)
+}
+
+func (it *ScanIterator) Next() bool {
+	return it.NextContext(context.Background())
+}
+
+// Move to the next key, and return false once there are no more or
+// something failed, see Err.
+func (it *ScanIterator) NextContext(ctx context.Context) bool {
+	for {
+		if len(it.keys) > 0 {
+			it.key, it.keys = it.keys[0], it.keys[1:]
+			return true
+		}
+		if it.err != nil || it.done {
+			return false
+		}
+		if it.task == nil {
+			it.nextTask()
+			continue
+		}
+		cursor, keys, err := scanBatch(ctx, it.task, it.cursor, it.args)
+		if err != nil {
+			if it.coverage == nil || ctx.Err() != nil || isCommandError(err) {
+				it.err = err
+				return false
+			}
+			it.coverage.fail(it.task, err)
+			it.task = nil
+			continue
+		}
+		it.keys, it.cursor = keys, cursor
+		if cursor == "0" {
+			if it.coverage != nil {
+				it.coverage.finish(it.task)
+			}
+			it.task = nil
+		}
+	}
+}
+
+func (it *ScanIterator) nextTask() {
+	if len(it.tasks) == 0 && it.coverage != nil {
+		it.tasks, it.err = it.coverage.round()
+	}
+	if len(it.tasks) == 0 {
+		it.done = true
+		return
+	}
+	it.task, it.tasks, it.cursor = it.tasks[0], it.tasks[1:], "0"
+	if it.coverage != nil {
+		it.coverage.start(it.task)
+	}
+}
+
+// The current key.
+func (it *ScanIterator) Key() string {
+	return it.key
+}
+
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+// Scan the masters concurrently, calling fn for every key from one
+// goroutine per master. Stop at the first error, of fn included.
+func (self *RedisCluster) ScanEach(ctx context.Context, match string, count int, typ string, fn func(key string) error) error {
+	if self.err != nil {
+		return self.err
+	}
+	args := scanArgs(match, count, typ)
+	table := self.loadTable()
+	if table.single {
+		for _, handle := range table.handles {
+			err := scanNode(ctx, &scanTask{pool: handle.pool}, args, fn)
+			if stop, ok := err.(scanStopped); ok {
+				return stop.err
+			}
+			return err
+		}
+		return ErrNoHandle
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	coverage := &scanCoverage{cluster: self, covered: make(map[uint16]bool)}
+	for {
+		tasks, err := coverage.round()
+		if err != nil || len(tasks) == 0 {
+			return err
+		}
+		var (
+			wg       sync.WaitGroup
+			mutex    sync.Mutex
+			firstErr error
+		)
+		for _, task := range tasks {
+			coverage.start(task)
+			wg.Add(1)
+			go func(task *scanTask) {
+				defer wg.Done()
+				err := scanNode(ctx, task, args, fn)
+				if err == nil {
+					coverage.finish(task)
+					return
+				}
+				var stop scanStopped
+				if errors.As(err, &stop) {
+					err = stop.err
+				} else if ctx.Err() == nil && !isCommandError(err) {
+					coverage.fail(task, err)
+					return
+				}
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mutex.Unlock()
+			}(task)
+		}
+		wg.Wait()
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+}
+
+// An error of the callback of ScanEach.
+type scanStopped struct {
+	err error
+}
+
+func (e scanStopped) Error() string {
+	return e.err.Error()
+}
+
+func scanNode(ctx context.Context, task *scanTask, args []interface{}, fn func(key string) error) error {
+	cursor := "0"
+	for {
+		next, keys, err := scanBatch(ctx, task, cursor, args)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return scanStopped{err}
+			}
+		}
+		if cursor = next; cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// Run one SCAN, and return the next cursor and the keys of the slots of
+// the task.
+func scanBatch(ctx context.Context, task *scanTask, cursor string, args []interface{}) (string, []string, error) {
+	values, err := redis.Values(task.pool.DoContext(ctx, "SCAN", append([]interface{}{cursor}, args...)...))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(values) != 2 {
+		return "", nil, errUnexpectedReply("SCAN", values)
+	}
+	next, err := redis.String(values[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	keys, err := redis.Strings(values[1], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if task.slots != nil {
+		kept := keys[:0]
+		for _, key := range keys {
+			if task.slots[HashSlot(key)] {
+				kept = append(kept, key)
+			}
+		}
+		keys = kept
+	}
+	return next, keys, nil
+}
+
+// Return the addresses of the masters serving slots, or the node of the
+// single mode.
+func masterAddrs(table *clusterTable) []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	if table.single {
+		for addr := range table.handles {
+			addrs = append(addrs, addr)
+		}
+		return addrs
+	}
+	for _, addr := range table.slots {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func ownedSlots(table *clusterTable, addr string) map[uint16]bool {
+	owned := make(map[uint16]bool)
+	for slot, owner := range table.slots {
+		if owner == addr {
+			owned[slot] = true
+		}
+	}
+	return owned
+}
+
+// Run the command on every master concurrently, and return the replies by
+// address with the first error.
+func (self *RedisCluster) DoAllMasters(ctx context.Context, cmd string, args ...interface{}) (map[string]interface{}, error) {
+	if self.err != nil {
+		return nil, self.err
+	}
+	table := self.loadTable()
+	addrs := masterAddrs(table)
+	if len(addrs) == 0 {
+		return nil, ErrNoHandle
+	}
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		replies  = make(map[string]interface{})
+		firstErr error
+	)
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			reply, err := self.handleForAddr(addr).DoContext(ctx, cmd, args...)
+			mutex.Lock()
+			defer mutex.Unlock()
+			replies[addr] = reply
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", addr, err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+	return replies, firstErr
+}
+
+// Return the number of keys of the cluster, the sum of DBSIZE on every
+// master.
+func (self *RedisCluster) DBSize() (int64, error) {
+	replies, err := self.DoAllMasters(context.Background(), "DBSIZE")
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, reply := range replies {
+		n, err := redis.Int64(reply, nil)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Delete every key of the cluster, with FLUSHALL on every master. Give
+// "ASYNC" to flush in the background.
+func (self *RedisCluster) FlushAll(args ...interface{}) error {
+	_, err := self.DoAllMasters(context.Background(), "FLUSHALL", args...)
+	return err
+}
+
+// Load the script on every master, and return its SHA1.
+func (self *RedisCluster) ScriptLoad(src string) (string, error) {
+	replies, err := self.DoAllMasters(context.Background(), "SCRIPT", "LOAD", src)
+	if err != nil {
+		return "", err
+	}
+	var sha string
+	for _, reply := range replies {
+		if sha, err = redis.String(reply, nil); err != nil {
+			return "", err
+		}
+	}
+	return sha, nil
+}
@@ -0,0 +1,187 @@
+package goredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// Collect the keys of the iterator, calling step after the first one.
+func collectKeys(t *testing.T, it *ScanIterator, step func()) map[string]int {
+	t.Helper()
+	keys := make(map[string]int)
+	for it.Next() {
+		keys[it.Key()]++
+		if len(keys) == 1 && step != nil {
+			step()
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func setKeys(t *testing.T, do func(string, ...interface{}) (interface{}, error), prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := do("SET", fmt.Sprint(prefix, i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPoolScan(t *testing.T) {
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+	setKeys(t, pool.Do, "user:", 25)
+	setKeys(t, pool.Do, "other:", 5)
+
+	keys := collectKeys(t, pool.Scan("user:*", 7, ""), nil)
+	if len(keys) != 25 {
+		t.Error("keys:", len(keys))
+	}
+	if n := server.count("SCAN"); n < 4 {
+		t.Error("SCAN sent", n, "times")
+	}
+	if keys := collectKeys(t, pool.Scan("", 0, "hash"), nil); len(keys) != 0 {
+		t.Error("keys of type hash:", len(keys))
+	}
+}
+
+func TestClusterScan(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	setKeys(t, cluster.Do, "key:", 100)
+
+	refreshes := fc.count("CLUSTER SLOTS")
+	keys := collectKeys(t, cluster.Scan("key:*", 10, ""), nil)
+	if len(keys) != 100 {
+		t.Error("keys:", len(keys))
+	}
+	// one refresh, at the end of the round
+	if n := fc.count("CLUSTER SLOTS") - refreshes; n != 1 {
+		t.Error("refreshed", n, "times")
+	}
+	for i, node := range fc.nodes {
+		if node.count("SCAN") == 0 {
+			t.Error("node", i, "not scanned")
+		}
+	}
+
+	// the masters are scanned in the order of their addresses, the slots
+	// of the last one move to the first while it is being scanned
+	addrs := append([]string{}, fc.addrs()...)
+	sort.Strings(addrs)
+	index := func(addr string) int {
+		for i, node := range fc.nodes {
+			if node.addr == addr {
+				return i
+			}
+		}
+		return -1
+	}
+	first, last := index(addrs[0]), index(addrs[2])
+	keys = collectKeys(t, cluster.Scan("", 10, ""), func() {
+		for _, r := range fc.ranges()[last] {
+			fc.move(r[0], r[1], first)
+		}
+	})
+	if len(keys) != 100 {
+		t.Error("keys after resharding:", len(keys))
+	}
+}
+
+func TestClusterScanFailover(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	setKeys(t, cluster.Do, "key:", 100)
+
+	// a node dies, another one takes its slots, with its keys as a
+	// promoted replica would
+	addrs := append([]string{}, fc.addrs()...)
+	sort.Strings(addrs)
+	var dead, heir int
+	for i, node := range fc.nodes {
+		switch node.addr {
+		case addrs[2]:
+			dead = i
+		case addrs[0]:
+			heir = i
+		}
+	}
+	keys := collectKeys(t, cluster.Scan("", 10, ""), func() {
+		fc.nodes[dead].Close()
+		for _, r := range fc.ranges()[dead] {
+			fc.move(r[0], r[1], heir)
+		}
+	})
+	if len(keys) != 100 {
+		t.Error("keys after failover:", len(keys))
+	}
+}
+
+func TestClusterScanEach(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	setKeys(t, cluster.Do, "key:", 100)
+
+	var (
+		mutex sync.Mutex
+		keys  = make(map[string]bool)
+	)
+	err := cluster.ScanEach(context.Background(), "", 10, "", func(key string) error {
+		mutex.Lock()
+		keys[key] = true
+		mutex.Unlock()
+		return nil
+	})
+	if err != nil || len(keys) != 100 {
+		t.Error("keys:", len(keys), err)
+	}
+
+	stop := errors.New("stop")
+	err = cluster.ScanEach(context.Background(), "", 10, "", func(key string) error {
+		return stop
+	})
+	if err != stop {
+		t.Error("stop:", err)
+	}
+}
+
+func TestClusterFanOut(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+	setKeys(t, cluster.Do, "key:", 100)
+
+	if n, err := cluster.DBSize(); err != nil || n != 100 {
+		t.Error("dbsize:", n, err)
+	}
+	sha, err := cluster.ScriptLoad("return redis.call('GET', KEYS[1])")
+	if err != nil || sha != NewScript(1, "return redis.call('GET', KEYS[1])").Hash() {
+		t.Error("script load:", sha, err)
+	}
+	for i, node := range fc.nodes {
+		if n := node.count("SCRIPT LOAD"); n != 1 {
+			t.Error("node", i, "got", n, "SCRIPT LOAD")
+		}
+	}
+	if err := cluster.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := cluster.DBSize(); err != nil || n != 0 {
+		t.Error("dbsize after flush:", n, err)
+	}
+}
@@ -0,0 +1,98 @@
+package goredis
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// Scripter runs the commands of scripts and functions. Pool, RedisHandle
+// and RedisCluster are ones, the cluster routing by the keys given.
+type Scripter interface {
+	DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error)
+}
+
+// Script is a Lua script run with EVALSHA, and with EVAL on the nodes
+// which don't have it cached yet. On a cluster its keys must hash to the
+// same slot, the script runs on the node serving it, or on any node when
+// it has no keys.
+type Script struct {
+	keyCount int
+	src      string
+	hash     string
+}
+
+// Return a script taking keyCount keys. With a negative keyCount, the
+// number of keys is given as first argument of every call.
+func NewScript(keyCount int, src string) *Script {
+	h := sha1.Sum([]byte(src))
+	return &Script{keyCount: keyCount, src: src, hash: hex.EncodeToString(h[:])}
+}
+
+// The SHA1 of the source, as used by EVALSHA.
+func (s *Script) Hash() string {
+	return s.hash
+}
+
+func (s *Script) args(spec string, keysAndArgs []interface{}) []interface{} {
+	if s.keyCount < 0 {
+		return append([]interface{}{spec}, keysAndArgs...)
+	}
+	return append([]interface{}{spec, s.keyCount}, keysAndArgs...)
+}
+
+// Run the script with the keys then the arguments.
+func (s *Script) Do(c Scripter, keysAndArgs ...interface{}) (interface{}, error) {
+	return s.DoContext(context.Background(), c, keysAndArgs...)
+}
+
+func (s *Script) DoContext(ctx context.Context, c Scripter, keysAndArgs ...interface{}) (interface{}, error) {
+	args := s.args(s.hash, keysAndArgs)
+	reply, err := c.DoContext(ctx, "EVALSHA", args...)
+	if isNoScript(err) {
+		// EVAL caches the script on the node for the next calls
+		args[0] = s.src
+		reply, err = c.DoContext(ctx, "EVAL", args...)
+	}
+	return reply, err
+}
+
+// Load the script with SCRIPT LOAD, on every master of a cluster, to save
+// the EVAL of the first calls.
+func (s *Script) Load(c Scripter) error {
+	return s.LoadContext(context.Background(), c)
+}
+
+func (s *Script) LoadContext(ctx context.Context, c Scripter) error {
+	if cluster, ok := c.(*RedisCluster); ok {
+		_, err := cluster.DoAllMasters(ctx, "SCRIPT", "LOAD", s.src)
+		return err
+	}
+	_, err := c.DoContext(ctx, "SCRIPT", "LOAD", s.src)
+	return err
+}
+
+// Call the Redis 7 function with FCALL, the first numKeys of keysAndArgs
+// being its keys.
+func FCall(c Scripter, function string, numKeys int, keysAndArgs ...interface{}) (interface{}, error) {
+	return FCallContext(context.Background(), c, function, numKeys, keysAndArgs...)
+}
+
+func FCallContext(ctx context.Context, c Scripter, function string, numKeys int, keysAndArgs ...interface{}) (interface{}, error) {
+	return c.DoContext(ctx, "FCALL", append([]interface{}{function, numKeys}, keysAndArgs...)...)
+}
+
+// Same as FCall with FCALL_RO, for the functions flagged no-writes, which
+// a cluster sends to the replicas as the read preference says.
+func FCallRO(c Scripter, function string, numKeys int, keysAndArgs ...interface{}) (interface{}, error) {
+	return FCallROContext(context.Background(), c, function, numKeys, keysAndArgs...)
+}
+
+func FCallROContext(ctx context.Context, c Scripter, function string, numKeys int, keysAndArgs ...interface{}) (interface{}, error) {
+	return c.DoContext(ctx, "FCALL_RO", append([]interface{}{function, numKeys}, keysAndArgs...)...)
+}
+
+func isNoScript(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
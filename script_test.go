@@ -0,0 +1,110 @@
+package goredis
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestPoolScript(t *testing.T) {
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+
+	set := NewScript(1, "return redis.call('SET', KEYS[1], ARGV[1])")
+	for i := 0; i < 3; i++ {
+		if reply, err := set.Do(pool, "foo", "bar"); err != nil || reply != "OK" {
+			t.Fatal(reply, err)
+		}
+	}
+	// EVAL once, on NOSCRIPT
+	if n := server.count("EVALSHA"); n != 3 {
+		t.Error("EVALSHA sent", n, "times")
+	}
+	if n := server.count("EVAL"); n != 1 {
+		t.Error("EVAL sent", n, "times")
+	}
+
+	// the number of keys as first argument
+	get := NewScript(-1, "return redis.call('GET', KEYS[1])")
+	if err := get.Load(pool); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := redis.String(get.Do(pool, 1, "foo")); err != nil || v != "bar" {
+		t.Fatal(v, err)
+	}
+	if n := server.count("EVAL"); n != 1 {
+		t.Error("EVAL sent for a loaded script")
+	}
+	if get.Hash() != "d3c21d0c2b9ca22f82737626a27bcaf5d288f99f" {
+		t.Error("hash:", get.Hash())
+	}
+}
+
+func TestClusterScript(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+
+	set := NewScript(1, "return redis.call('SET', KEYS[1], ARGV[1])")
+	for i := 0; i < 30; i++ {
+		if _, err := set.Do(cluster, fmt.Sprint("key:", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// routed by key, each node caching the script on its first call
+	for i, node := range fc.nodes {
+		if n := node.count("EVAL"); n != 1 {
+			t.Error("node", i, "got", n, "EVAL")
+		}
+	}
+	if v, err := redis.String(cluster.Do("GET", "key:7")); err != nil || v != "7" {
+		t.Error(v, err)
+	}
+
+	two := NewScript(2, "return redis.call('MSET', KEYS[1], ARGV[1], KEYS[2], ARGV[2])")
+	if _, err := two.Do(cluster, "a", "b", 1, 2); !errors.Is(err, ErrCrossSlot) {
+		t.Error("cross slot:", err)
+	}
+	if _, err := two.Do(cluster, "{user}a", "{user}b", 1, 2); err != nil {
+		t.Error(err)
+	}
+
+	// no keys, any node
+	ping := NewScript(0, "return redis.call('PING')")
+	if err := ping.Load(cluster); err != nil {
+		t.Fatal(err)
+	}
+	for i, node := range fc.nodes {
+		if n := node.count("SCRIPT LOAD"); n != 1 {
+			t.Error("node", i, "got", n, "SCRIPT LOAD")
+		}
+	}
+	if v, err := redis.String(ping.Do(cluster)); err != nil || v != "PONG" {
+		t.Error(v, err)
+	}
+}
+
+func TestClusterFCall(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	fc.store.functions["setter"] = "SET"
+	fc.store.functions["getter"] = "GET"
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+
+	for i := 0; i < 30; i++ {
+		if _, err := FCall(cluster, "setter", 1, fmt.Sprint("key:", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := redis.String(FCallRO(cluster, "getter", 1, "key:3")); err != nil || v != "3" {
+		t.Error(v, err)
+	}
+	if _, err := FCall(cluster, "missing", 0); err == nil {
+		t.Error("missing function")
+	}
+}
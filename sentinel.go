@@ -0,0 +1,561 @@
+package goredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	ErrNoMaster  = errors.New("no sentinel knows the master")
+	ErrWrongRole = errors.New("node doesn't have the expected role")
+)
+
+// The channels on which the sentinels announce the failovers, and the
+// nodes going down or up again.
+const (
+	sentinelSwitchChannel = "+switch-master"
+	sentinelDownChannel   = "+sdown"
+	sentinelUpChannel     = "-sdown"
+)
+
+// SentinelHandle is the client of a master monitored by Redis Sentinel. It
+// asks the sentinels for the address of the master, and follows the
+// failovers they announce on +switch-master, replacing the pool of the
+// master. The replicas are listed along with the master, and again when
+// a node goes down or up. Every connection checks the role of its node
+// with ROLE, so that a failover missed while the sentinels were out of
+// reach is noticed on the next dial. It is safe for concurrent use.
+type SentinelHandle struct {
+	MasterName string
+	MaxIdle    int
+	MaxActive  int
+	Debug      bool
+
+	options         DialOptions // of the master and the replicas
+	sentinelOptions DialOptions
+
+	mutex       sync.Mutex
+	sentinels   []string     // the last one which answered first
+	master      atomic.Value // *RedisHandle
+	replicas    map[string]*RedisHandle
+	replicaList []string // the replicas up, nil until the sentinels listed them
+	closed      bool
+	watch       *PubSub
+	watching    int32
+	discovering int32
+	listing     int32
+	logger      atomic.Value // loggerHolder
+	hooks       atomic.Value // *hookList
+}
+
+// Create a client of the master named masterName. The error of the
+// sentinels is returned by the commands until one of them answers, use
+// DialSentinel to check it at once.
+func NewSentinelHandle(masterName string, sentinels []string, max_idle, max_active int, debug bool) *SentinelHandle {
+	handle, _ := DialSentinel(masterName, sentinels, max_idle, max_active, debug)
+	return handle
+}
+
+// Create a client of the master named masterName, and return the error if
+// no sentinel gave its address. The client is returned in any case, it
+// keeps asking the sentinels.
+func DialSentinel(masterName string, sentinels []string, max_idle, max_active int, debug bool) (*SentinelHandle, error) {
+	return DialSentinelWithOptions(masterName, sentinels, max_idle, max_active, debug, DialOptions{}, DialOptions{})
+}
+
+// Same as DialSentinel, options apply to the connections to the master and
+// the replicas, sentinelOptions to the ones to the sentinels, which have
+// their own password if any.
+func DialSentinelWithOptions(masterName string, sentinels []string, max_idle, max_active int, debug bool, options, sentinelOptions DialOptions) (*SentinelHandle, error) {
+	sentinelOptions.Database = 0
+	this := &SentinelHandle{
+		MasterName:      masterName,
+		MaxIdle:         max_idle,
+		MaxActive:       max_active,
+		Debug:           debug,
+		options:         options,
+		sentinelOptions: sentinelOptions,
+		sentinels:       append([]string{}, sentinels...),
+		replicas:        make(map[string]*RedisHandle),
+	}
+	this.watch = newPubSub(func(string) string { return "" }, this.sentinelDial, func() {}, this.log)
+	// the failovers announced while the subscription was lost are missed
+	this.watch.restored = this.scheduleDiscover
+	go this.follow()
+	_, err := this.discover(context.Background())
+	return this, err
+}
+
+func (this *SentinelHandle) log() Logger {
+	if holder, ok := this.logger.Load().(loggerHolder); ok {
+		return holder.Logger
+	}
+	return LoggerWith(stdLogger{prefix: "[SentinelHandle] ", debug: this.Debug}, "master", this.MasterName)
+}
+
+// Set the logger of the handle and of the pools of its nodes.
+func (this *SentinelHandle) SetLogger(logger Logger) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.logger.Store(loggerHolder{LoggerWith(logger, "master", this.MasterName)})
+	for _, handle := range this.handles() {
+		handle.SetLogger(this.nodeLog(handle.Addr, handle != this.Master()))
+	}
+}
+
+// Add a hook seeing the commands, pipelines and dials of the master and
+// the replicas.
+func (this *SentinelHandle) AddHook(hook Hook) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	addHook(&this.hooks, hook)
+	for _, handle := range this.handles() {
+		handle.AddHook(hook)
+	}
+}
+
+// Return the handle of the current master, nil until a sentinel gave its
+// address.
+func (this *SentinelHandle) Master() *RedisHandle {
+	handle, _ := this.master.Load().(*RedisHandle)
+	return handle
+}
+
+// Return the address of the current master, "" if unknown.
+func (this *SentinelHandle) MasterAddr() string {
+	if handle := this.Master(); handle != nil {
+		return handle.Addr
+	}
+	return ""
+}
+
+func (this *SentinelHandle) masterHandle(ctx context.Context) (*RedisHandle, error) {
+	if handle := this.Master(); handle != nil {
+		return handle, nil
+	}
+	if _, err := this.discover(ctx); err != nil {
+		return nil, err
+	}
+	return this.Master(), nil
+}
+
+func (this *SentinelHandle) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return this.DoContext(context.Background(), cmd, args...)
+}
+
+// Send the command to the master. A master turned replica behind our back
+// answers the writes with READONLY, which makes the sentinels asked again.
+func (this *SentinelHandle) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	handle, err := this.masterHandle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := handle.DoContext(ctx, cmd, args...)
+	if err != nil && strings.HasPrefix(err.Error(), "READONLY") {
+		this.scheduleDiscover()
+	}
+	return reply, err
+}
+
+// Return a connection to the master, to give back with Close.
+func (this *SentinelHandle) Get() *RedisConn {
+	return this.GetContext(context.Background())
+}
+
+func (this *SentinelHandle) GetContext(ctx context.Context) *RedisConn {
+	handle, err := this.masterHandle(ctx)
+	if err != nil {
+		return &RedisConn{err: err}
+	}
+	return handle.GetContext(ctx)
+}
+
+// Send the commands in one pipeline to the master, see RedisConn.DoMulti.
+func (this *SentinelHandle) Pipeline(commands Commands) ([]*RedisReply, error) {
+	c := this.Get()
+	defer c.Close()
+	return c.DoMulti(commands)
+}
+
+// Return a PubSub dialing the current master.
+func (this *SentinelHandle) PubSub() *PubSub {
+	return newPubSub(
+		func(channel string) string { return "" },
+		func(ctx context.Context, key string) (string, redis.Conn, error) {
+			handle, err := this.masterHandle(ctx)
+			if err != nil {
+				return "", nil, err
+			}
+			conn, err := handle.pool.dial(ctx)
+			return handle.Addr, conn, err
+		},
+		func() {},
+		this.log)
+}
+
+// Return the addresses of the replicas of the master which the sentinels
+// see up, asking them.
+func (this *SentinelHandle) Replicas() ([]string, error) {
+	return this.ReplicasContext(context.Background())
+}
+
+func (this *SentinelHandle) ReplicasContext(ctx context.Context) ([]string, error) {
+	var lastErr error = ErrNoMaster
+	for _, sentinel := range this.sentinelAddrs() {
+		reply, err := this.sentinelDo(ctx, sentinel, "SENTINEL", "REPLICAS", this.MasterName)
+		if err != nil && strings.HasPrefix(err.Error(), "ERR") {
+			// before Redis 5
+			reply, err = this.sentinelDo(ctx, sentinel, "SENTINEL", "SLAVES", this.MasterName)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs, err := parseSentinelReplicas(reply)
+		if err != nil {
+			return nil, err
+		}
+		this.setReplicas(addrs)
+		return addrs, nil
+	}
+	return nil, lastErr
+}
+
+// Keep the list of the replicas, and close the pools of the ones gone.
+func (this *SentinelHandle) setReplicas(addrs []string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return
+	}
+	this.replicaList = append([]string{}, addrs...)
+	listed := make(map[string]bool)
+	for _, addr := range addrs {
+		listed[addr] = true
+	}
+	for addr, handle := range this.replicas {
+		if !listed[addr] {
+			delete(this.replicas, addr)
+			handle.pool.Close()
+		}
+	}
+}
+
+// List the replicas again in the background, unless it is being done
+// already.
+func (this *SentinelHandle) scheduleReplicas() {
+	if !atomic.CompareAndSwapInt32(&this.listing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&this.listing, 0)
+		if _, err := this.Replicas(); err != nil {
+			this.log().Warn("Sentinel Replicas Failed", "error", err)
+		}
+	}()
+}
+
+// Return the handle of a random replica, or of the master when there is
+// none, for the reads which may be stale. The replicas are the ones the
+// sentinels listed last.
+func (this *SentinelHandle) ReplicaHandle() (*RedisHandle, error) {
+	this.mutex.Lock()
+	addrs := this.replicaList
+	this.mutex.Unlock()
+	if addrs == nil {
+		addrs, _ = this.Replicas()
+	}
+	if len(addrs) == 0 {
+		return this.masterHandle(context.Background())
+	}
+	addr := addrs[rand.Intn(len(addrs))]
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return nil, ErrNoHandle
+	}
+	handle, ok := this.replicas[addr]
+	if !ok {
+		handle = this.newHandle(addr, "slave")
+		this.replicas[addr] = handle
+	}
+	return handle, nil
+}
+
+// Return the stats of the pools by node address.
+func (this *SentinelHandle) Stats() map[string]PoolStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	stats := make(map[string]PoolStats)
+	for _, handle := range this.handles() {
+		stats[handle.Addr] = stats[handle.Addr].Add(handle.pool.Stats())
+	}
+	return stats
+}
+
+// Stop following the failovers and close the connections.
+func (this *SentinelHandle) Close() {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return
+	}
+	this.closed = true
+	handles := this.handles()
+	this.mutex.Unlock()
+	this.watch.Close()
+	for _, handle := range handles {
+		handle.pool.Close()
+	}
+}
+
+// Return the handles of the master and the replicas. Called with the
+// mutex held.
+func (this *SentinelHandle) handles() []*RedisHandle {
+	var handles []*RedisHandle
+	if master := this.Master(); master != nil {
+		handles = append(handles, master)
+	}
+	for _, handle := range this.replicas {
+		handles = append(handles, handle)
+	}
+	return handles
+}
+
+func (this *SentinelHandle) nodeLog(addr string, replica bool) Logger {
+	if replica {
+		return LoggerWith(this.log(), "node", addr, "replica", true)
+	}
+	return LoggerWith(this.log(), "node", addr)
+}
+
+// Return a handle to the node at addr, whose connections check that it
+// has the role, "master" or "slave". Called with the mutex held.
+func (this *SentinelHandle) newHandle(addr, role string) *RedisHandle {
+	handle := newRedisHandle(addr, this.MaxIdle, this.MaxActive, this.Debug, false, this.options)
+	dial := handle.pool.callback
+	handle.pool.callback = func(ctx context.Context) (redis.Conn, error) {
+		c, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := this.checkRole(c, addr, role); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	for _, hook := range loadHooks(&this.hooks) {
+		handle.AddHook(hook)
+	}
+	handle.SetLogger(this.nodeLog(addr, role != "master"))
+	return handle
+}
+
+func (this *SentinelHandle) checkRole(c redis.Conn, addr, role string) error {
+	reply, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "ERR unknown command") {
+			// before Redis 2.8.12, trust the sentinels
+			return nil
+		}
+		return err
+	}
+	if len(reply) == 0 {
+		return errUnexpectedReply("ROLE", reply)
+	}
+	got, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if got != role {
+		if role == "master" {
+			// a failover we missed
+			this.scheduleDiscover()
+		}
+		return fmt.Errorf("%w: %s is a %s, not a %s", ErrWrongRole, addr, got, role)
+	}
+	return nil
+}
+
+func (this *SentinelHandle) sentinelAddrs() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]string{}, this.sentinels...)
+}
+
+// Ask the sentinels for the address of the master, in order, and switch to
+// it. The first one answering is asked first next time.
+func (this *SentinelHandle) discover(ctx context.Context) (string, error) {
+	var lastErr error = ErrNoMaster
+	for _, sentinel := range this.sentinelAddrs() {
+		reply, err := this.sentinelDo(ctx, sentinel, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", this.MasterName)
+		if err == nil && reply == nil {
+			err = fmt.Errorf("%w: %s unknown to %s", ErrNoMaster, this.MasterName, sentinel)
+		}
+		var addr []string
+		if err == nil {
+			addr, err = redis.Strings(reply, nil)
+			if err == nil && len(addr) != 2 {
+				err = errUnexpectedReply("SENTINEL GET-MASTER-ADDR-BY-NAME", reply)
+			}
+		}
+		if err != nil {
+			this.log().Warn("Sentinel Failed", "sentinel", sentinel, "error", err)
+			lastErr = err
+			continue
+		}
+		this.preferSentinel(sentinel)
+		master := net.JoinHostPort(addr[0], addr[1])
+		this.switchMaster(master)
+		if _, err := this.ReplicasContext(ctx); err != nil {
+			this.log().Warn("Sentinel Replicas Failed", "sentinel", sentinel, "error", err)
+		}
+		this.startWatch()
+		return master, nil
+	}
+	return "", lastErr
+}
+
+// Ask the sentinels again in the background, unless it is being done
+// already.
+func (this *SentinelHandle) scheduleDiscover() {
+	if !atomic.CompareAndSwapInt32(&this.discovering, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&this.discovering, 0)
+		this.discover(context.Background())
+	}()
+}
+
+func (this *SentinelHandle) preferSentinel(sentinel string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for i, addr := range this.sentinels {
+		if addr == sentinel {
+			copy(this.sentinels[1:i+1], this.sentinels[:i])
+			this.sentinels[0] = sentinel
+			return
+		}
+	}
+}
+
+// Replace the pool of the master when it moved to addr.
+func (this *SentinelHandle) switchMaster(addr string) {
+	this.mutex.Lock()
+	old := this.Master()
+	if this.closed || old != nil && old.Addr == addr {
+		this.mutex.Unlock()
+		return
+	}
+	this.master.Store(this.newHandle(addr, "master"))
+	this.mutex.Unlock()
+	if old != nil {
+		this.log().Info("Master Switched", "from", old.Addr, "to", addr)
+		old.pool.Close()
+	} else {
+		this.log().Debug("Master Found", "node", addr)
+	}
+}
+
+// Subscribe to the failovers once a sentinel answered, and ask again for
+// the master once subscribed, in case it moved meanwhile.
+func (this *SentinelHandle) startWatch() {
+	if !atomic.CompareAndSwapInt32(&this.watching, 0, 1) {
+		return
+	}
+	go func() {
+		err := this.watch.Subscribe(sentinelSwitchChannel, sentinelDownChannel, sentinelUpChannel)
+		if err == nil {
+			this.scheduleDiscover()
+		} else if err != ErrPubSubClosed {
+			this.log().Warn("Sentinel Subscribe Failed", "error", err)
+			atomic.StoreInt32(&this.watching, 0)
+		}
+	}()
+}
+
+// Switch to the masters announced by the sentinels, and list the replicas
+// again when they change, until Close.
+func (this *SentinelHandle) follow() {
+	for msg := range this.watch.Messages() {
+		fields := strings.Fields(string(msg.Data))
+		switch msg.Channel {
+		case sentinelSwitchChannel:
+			// <master name> <old ip> <old port> <new ip> <new port>
+			if len(fields) != 5 || fields[0] != this.MasterName {
+				continue
+			}
+			this.switchMaster(net.JoinHostPort(fields[3], fields[4]))
+			this.scheduleReplicas()
+		case sentinelDownChannel, sentinelUpChannel:
+			// master <name> <ip> <port>, or
+			// <type> <name> <ip> <port> @ <master name> <master ip> <master port>
+			if len(fields) >= 4 && fields[0] == "master" && fields[1] == this.MasterName ||
+				len(fields) >= 6 && fields[4] == "@" && fields[5] == this.MasterName {
+				this.scheduleReplicas()
+			}
+		}
+	}
+}
+
+// Dial the first sentinel answering, for the subscription to the
+// failovers.
+func (this *SentinelHandle) sentinelDial(ctx context.Context, key string) (string, redis.Conn, error) {
+	var lastErr error = ErrNoMaster
+	for _, sentinel := range this.sentinelAddrs() {
+		conn, err := this.sentinelOptions.dial(ctx, sentinel)
+		if err == nil {
+			return sentinel, conn, nil
+		}
+		lastErr = err
+	}
+	return "", nil, lastErr
+}
+
+// Send a command to the sentinel, on a connection of its own: they are
+// asked rarely.
+func (this *SentinelHandle) sentinelDo(ctx context.Context, sentinel, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := this.sentinelOptions.dial(ctx, sentinel)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := &RedisConn{conn: conn}
+	return c.doContext(ctx, cmd, args...)
+}
+
+// Return the addresses of the replicas listed by SENTINEL REPLICAS, but
+// the ones down or disconnected.
+func parseSentinelReplicas(reply interface{}) ([]string, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, value := range values {
+		fields, err := redis.StringMap(value, nil)
+		if err != nil {
+			return nil, err
+		}
+		down := false
+		for _, flag := range strings.Split(fields["flags"], ",") {
+			if flag == "s_down" || flag == "o_down" || flag == "disconnected" {
+				down = true
+			}
+		}
+		if !down && fields["ip"] != "" {
+			addrs = append(addrs, net.JoinHostPort(fields["ip"], fields["port"]))
+		}
+	}
+	return addrs, nil
+}
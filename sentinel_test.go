@@ -0,0 +1,206 @@
+package goredis
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Wait until the handle talks to the master at addr, and the write
+// succeeds there.
+func waitMaster(t *testing.T, handle *SentinelHandle, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := handle.Do("SET", "foo", addr)
+		if err == nil && handle.MasterAddr() == addr {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("master %s, want %s: %v", handle.MasterAddr(), addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Wait until the handle lists the replica at addr.
+func waitReplica(t *testing.T, handle *SentinelHandle, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		handle.mutex.Lock()
+		replicas := handle.replicaList
+		handle.mutex.Unlock()
+		for _, replica := range replicas {
+			if replica == addr {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replicas %v, want %s", replicas, addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	rs := newFakeReplicaSet("mymaster", 3)
+	defer rs.Close()
+	// a sentinel down, skipped
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := ln.Addr().String()
+	ln.Close()
+
+	handle, err := DialSentinel("mymaster", []string{dead, rs.sentinel.addr}, 4, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	if handle.MasterAddr() != rs.nodes[0].addr {
+		t.Fatal("master:", handle.MasterAddr())
+	}
+	if _, err := handle.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if n := rs.nodes[0].count("SET"); n != 1 {
+		t.Error("SET sent", n, "times to the master")
+	}
+	// the sentinel answering is asked first from now on
+	if addrs := handle.sentinelAddrs(); addrs[0] != rs.sentinel.addr {
+		t.Error("sentinels:", addrs)
+	}
+
+	replicas, err := handle.Replicas()
+	if err != nil || len(replicas) != 2 {
+		t.Fatal("replicas:", replicas, err)
+	}
+	replica, err := handle.ReplicaHandle()
+	if err != nil || replica.Addr == rs.nodes[0].addr {
+		t.Fatal("replica:", replica, err)
+	}
+	if v, err := redis.String(replica.Do("GET", "foo")); err != nil || v != "bar" {
+		t.Error(v, err)
+	}
+	// the replicas are listed once per discovery, not per read
+	for i := 0; i < 20; i++ {
+		if _, err := handle.ReplicaHandle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, max := rs.sentinel.count("SENTINEL REPLICAS"), rs.sentinel.count("SENTINEL GET-MASTER-ADDR-BY-NAME")+1; n > max {
+		t.Error("replicas listed", n, "times")
+	}
+
+	// the failover is announced once the handle subscribed to it
+	deadline := time.Now().Add(2 * time.Second)
+	for rs.sentinel.count("SUBSCRIBE") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no subscription to the failovers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// counted before it is handled
+	time.Sleep(10 * time.Millisecond)
+	rs.failover(1, true)
+	deadline = time.Now().Add(2 * time.Second)
+	for handle.MasterAddr() != rs.nodes[1].addr {
+		if time.Now().After(deadline) {
+			t.Fatal("failover not followed, master", handle.MasterAddr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := handle.Do("SET", "foo", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if n := rs.nodes[1].count("SET"); n != 1 {
+		t.Error("SET sent", n, "times to the new master")
+	}
+	// the old master is listed as a replica
+	waitReplica(t, handle, rs.nodes[0].addr)
+
+	// a replica going down makes them listed again
+	listed := rs.sentinel.count("SENTINEL REPLICAS")
+	host, port, _ := net.SplitHostPort(rs.nodes[2].addr)
+	rs.events.publish([]string{"PUBLISH", "+sdown", "slave " + rs.nodes[2].addr + " " + host + " " + port + " @ mymaster 127.0.0.1 0"})
+	deadline = time.Now().Add(2 * time.Second)
+	for rs.sentinel.count("SENTINEL REPLICAS") == listed {
+		if time.Now().After(deadline) {
+			t.Fatal("replicas not listed again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := DialSentinel("other", []string{rs.sentinel.addr}, 4, 4, false); !errors.Is(err, ErrNoMaster) {
+		t.Error("unknown master:", err)
+	}
+}
+
+func TestSentinelMissedFailover(t *testing.T) {
+	rs := newFakeReplicaSet("mymaster", 3)
+	defer rs.Close()
+	handle, err := DialSentinel("mymaster", []string{rs.sentinel.addr}, 4, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	if _, err := handle.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old master answers READONLY on its open connections
+	rs.failover(1, false)
+	if _, err := handle.Do("SET", "foo", "bar"); err == nil {
+		t.Fatal("write on a replica")
+	}
+	waitMaster(t, handle, rs.nodes[1].addr)
+
+	// the connections are dialed again, and ROLE tells the node is not
+	// the master anymore
+	rs.failover(2, false)
+	rs.nodes[1].closeConns()
+	waitMaster(t, handle, rs.nodes[2].addr)
+	if rs.nodes[1].count("ROLE") < 2 {
+		t.Error("ROLE not checked")
+	}
+	// once at dial time, and once for each failover at least
+	if n := rs.sentinel.count("SENTINEL GET-MASTER-ADDR-BY-NAME"); n < 3 {
+		t.Error("sentinel asked", n, "times")
+	}
+}
+
+func TestSentinelResubscribe(t *testing.T) {
+	rs := newFakeReplicaSet("mymaster", 2)
+	defer rs.Close()
+	handle, err := DialSentinel("mymaster", []string{rs.sentinel.addr}, 4, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	// subscribed, and the master asked again once
+	deadline := time.Now().Add(2 * time.Second)
+	for rs.sentinel.count("SUBSCRIBE") == 0 || rs.sentinel.count("SENTINEL GET-MASTER-ADDR-BY-NAME") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("no subscription to the failovers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// a failover while the subscription is lost, without any command to
+	// notice it
+	rs.failover(1, false)
+	rs.sentinel.closeConns()
+	deadline = time.Now().Add(2 * time.Second)
+	for handle.MasterAddr() != rs.nodes[1].addr {
+		if time.Now().After(deadline) {
+			t.Fatal("failover missed, master", handle.MasterAddr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := rs.sentinel.count("SUBSCRIBE"); n < 2 {
+		t.Error("subscribed", n, "times")
+	}
+}
@@ -0,0 +1,174 @@
+package goredis
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A test CA, and the certificates it signs written as PEM files.
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{dir: t.TempDir()}
+	ca.cert, ca.key = ca.sign(t, "ca", &x509.Certificate{
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	})
+	ca.pool = x509.NewCertPool()
+	ca.pool.AddCert(ca.cert)
+	return ca
+}
+
+// Sign the template, self-signed for the CA itself, and write name.pem
+// and name-key.pem.
+func (ca *testCA) sign(t *testing.T, name string, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(ca.path(name), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(ca.path(name+"-key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name+".pem")
+}
+
+// Return the configuration of servers at 127.0.0.1 requiring a client
+// certificate signed by the CA.
+func (ca *testCA) serverConfig(t *testing.T) *tls.Config {
+	ca.sign(t, "server", &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	cert, err := tls.LoadX509KeyPair(ca.path("server"), ca.path("server-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func (ca *testCA) clientConfig(t *testing.T) *tls.Config {
+	ca.sign(t, "client", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	config, err := NewTLSConfig(ca.path("ca"), ca.path("client"), ca.path("client-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestRedisHandleTLS(t *testing.T) {
+	ca := newTestCA(t)
+	store := newFakeStore()
+	server := newFakeTLSServer(ca.serverConfig(t), func(c *fakeConn, args []string) interface{} {
+		return store.doConn(c, args)
+	})
+	defer server.Close()
+	client := ca.clientConfig(t)
+
+	handle := NewRedisHandleWithOptions(server.addr, 4, 4, false, DialOptions{TLSConfig: client})
+	defer handle.Close()
+	if _, err := handle.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate doesn't match that name
+	wrongName := client.Clone()
+	wrongName.ServerName = "redis.example.com"
+	bad := NewRedisHandleWithOptions(server.addr, 4, 4, false, DialOptions{TLSConfig: wrongName})
+	defer bad.Close()
+	if _, err := bad.Do("GET", "foo"); err == nil {
+		t.Error("server name not verified")
+	}
+
+	// skip verify, but no client certificate
+	insecure := &tls.Config{InsecureSkipVerify: true}
+	bad = NewRedisHandleWithOptions(server.addr, 4, 4, false, DialOptions{TLSConfig: insecure})
+	defer bad.Close()
+	if _, err := bad.Do("GET", "foo"); err == nil {
+		t.Error("client certificate not required")
+	}
+
+	plain := NewRedisHandle(server.addr, 4, 4, false)
+	defer plain.Close()
+	if _, err := plain.Do("GET", "foo"); err == nil {
+		t.Error("plain connection to a TLS server")
+	}
+}
+
+func TestClusterTLS(t *testing.T) {
+	ca := newTestCA(t)
+	fc := newFakeTLSCluster(3, ca.serverConfig(t))
+	defer fc.Close()
+	fc.addReplica(0)
+
+	cluster, err := DialClusterWithOptions(fc.addrs()[:1], 8, 8, false, DialOptions{
+		TLSConfig:      ca.clientConfig(t),
+		ConnectTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	if len(cluster.Topology().Masters) != 3 {
+		t.Fatal("masters:", len(cluster.Topology().Masters))
+	}
+	cluster.SetReadPreference(ReadPreferReplica)
+	for i := 0; i < 30; i++ {
+		if _, err := cluster.Do("SET", i, i); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cluster.Do("GET", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, node := range fc.nodes {
+		if node.count("GET")+node.count("SET") == 0 {
+			t.Error("node", i, "not used")
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package goredis
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	RoleMaster  = "master"
+	RoleReplica = "replica"
+)
+
+// An inclusive range of hash slots.
+type SlotRange struct {
+	Start uint16
+	End   uint16
+}
+
+type ClusterNode struct {
+	ID       string
+	Addr     string
+	Role     string
+	MasterID string   // master of a replica, when known
+	Flags    []string // as reported by CLUSTER NODES
+	Failed   bool     // flagged as failing, or not online
+	Slots    []SlotRange
+	// slots being moved out of or into this node, by the id of the
+	// node on the other end, as reported by CLUSTER NODES
+	Migrating map[uint16]string
+	Importing map[uint16]string
+	Replicas  []*ClusterNode
+}
+
+// The masters of a cluster with their slots and replicas.
+type ClusterTopology struct {
+	Masters []*ClusterNode
+}
+
+// Return the address of the master serving every assigned slot.
+func (t *ClusterTopology) Slots() map[uint16]string {
+	slots := make(map[uint16]string)
+	for _, master := range t.Masters {
+		for _, r := range master.Slots {
+			for slot := int(r.Start); slot <= int(r.End); slot++ {
+				slots[uint16(slot)] = master.Addr
+			}
+		}
+	}
+	return slots
+}
+
+// Return the addresses of every node, masters first.
+func (t *ClusterTopology) Addrs() []string {
+	var addrs []string
+	for _, master := range t.Masters {
+		addrs = append(addrs, master.Addr)
+	}
+	for _, master := range t.Masters {
+		for _, replica := range master.Replicas {
+			addrs = append(addrs, replica.Addr)
+		}
+	}
+	return addrs
+}
+
+// Collects the nodes of a reply, merging the entries of the same node.
+type topologyBuilder struct {
+	seed    string
+	masters []*ClusterNode
+	byKey   map[string]*ClusterNode
+}
+
+func newTopologyBuilder(seed string) *topologyBuilder {
+	return &topologyBuilder{seed: seed, byKey: make(map[string]*ClusterNode)}
+}
+
+// Return the node with this id, or this address when there is no id.
+func (b *topologyBuilder) node(id, addr string) *ClusterNode {
+	key := id
+	if key == "" {
+		key = addr
+	}
+	node, ok := b.byKey[key]
+	if !ok {
+		node = &ClusterNode{ID: id, Addr: addr}
+		b.byKey[key] = node
+	}
+	return node
+}
+
+func (b *topologyBuilder) addMaster(node *ClusterNode) {
+	for _, master := range b.masters {
+		if master == node {
+			return
+		}
+	}
+	node.Role = RoleMaster
+	b.masters = append(b.masters, node)
+}
+
+func (b *topologyBuilder) addReplica(master, node *ClusterNode) {
+	for _, replica := range master.Replicas {
+		if replica == node {
+			return
+		}
+	}
+	node.Role = RoleReplica
+	node.MasterID = master.ID
+	master.Replicas = append(master.Replicas, node)
+}
+
+func (b *topologyBuilder) topology() *ClusterTopology {
+	for _, master := range b.masters {
+		sort.Slice(master.Slots, func(i, j int) bool {
+			return master.Slots[i].Start < master.Slots[j].Start
+		})
+	}
+	return &ClusterTopology{Masters: b.masters}
+}
+
+// Return host:port, taking the host of the seed when the node does not
+// know its own address.
+func (b *topologyBuilder) addr(host string, port int) string {
+	if host == "" || host == "?" {
+		host, _, _ = net.SplitHostPort(b.seed)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func parseSlotRange(start, end int64) (SlotRange, error) {
+	if start < 0 || end < start || end >= RedisClusterHashSlots {
+		return SlotRange{}, fmt.Errorf("invalid slot range %d-%d", start, end)
+	}
+	return SlotRange{Start: uint16(start), End: uint16(end)}, nil
+}
+
+// Parse the reply of CLUSTER SLOTS. seed is the address of the node which
+// replied, used for the nodes announcing an empty host.
+func ParseClusterSlots(reply interface{}, seed string) (*ClusterTopology, error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	b := newTopologyBuilder(seed)
+	for _, e := range entries {
+		entry, err := redis.Values(e, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(entry) < 3 {
+			return nil, fmt.Errorf("CLUSTER SLOTS: short entry %v", entry)
+		}
+		start, err := redis.Int64(entry[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		end, err := redis.Int64(entry[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		r, err := parseSlotRange(start, end)
+		if err != nil {
+			return nil, err
+		}
+		var master *ClusterNode
+		for i, n := range entry[2:] {
+			fields, err := redis.Values(n, nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("CLUSTER SLOTS: short node %v", fields)
+			}
+			host, err := redis.String(fields[0], nil)
+			if err != nil {
+				return nil, err
+			}
+			port, err := redis.Int(fields[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			id := ""
+			if len(fields) > 2 {
+				if id, err = redis.String(fields[2], nil); err != nil {
+					return nil, err
+				}
+			}
+			node := b.node(id, b.addr(host, port))
+			if i == 0 {
+				master = node
+				b.addMaster(master)
+				master.Slots = append(master.Slots, r)
+			} else {
+				b.addReplica(master, node)
+			}
+		}
+	}
+	return b.topology(), nil
+}
+
+// Parse the reply of CLUSTER SHARDS, available since Redis 7.
+func ParseClusterShards(reply interface{}, seed string) (*ClusterTopology, error) {
+	shards, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	b := newTopologyBuilder(seed)
+	for _, s := range shards {
+		shard, err := redis.Values(s, nil)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			ranges []SlotRange
+			nodes  []*ClusterNode
+		)
+		for i := 0; i+1 < len(shard); i += 2 {
+			name, err := redis.String(shard[i], nil)
+			if err != nil {
+				return nil, err
+			}
+			switch name {
+			case "slots":
+				slots, err := redis.Values(shard[i+1], nil)
+				if err != nil {
+					return nil, err
+				}
+				for j := 0; j+1 < len(slots); j += 2 {
+					start, err := redis.Int64(slots[j], nil)
+					if err != nil {
+						return nil, err
+					}
+					end, err := redis.Int64(slots[j+1], nil)
+					if err != nil {
+						return nil, err
+					}
+					r, err := parseSlotRange(start, end)
+					if err != nil {
+						return nil, err
+					}
+					ranges = append(ranges, r)
+				}
+			case "nodes":
+				list, err := redis.Values(shard[i+1], nil)
+				if err != nil {
+					return nil, err
+				}
+				for _, n := range list {
+					node, err := b.shardNode(n)
+					if err != nil {
+						return nil, err
+					}
+					nodes = append(nodes, node)
+				}
+			}
+		}
+		var master *ClusterNode
+		for _, node := range nodes {
+			if node.Role == RoleMaster {
+				master = node
+			}
+		}
+		if master == nil {
+			if len(ranges) > 0 {
+				return nil, fmt.Errorf("CLUSTER SHARDS: no master for slots %v", ranges)
+			}
+			continue
+		}
+		b.addMaster(master)
+		master.Slots = append(master.Slots, ranges...)
+		for _, node := range nodes {
+			if node != master {
+				b.addReplica(master, node)
+			}
+		}
+	}
+	return b.topology(), nil
+}
+
+func (b *topologyBuilder) shardNode(reply interface{}) (*ClusterNode, error) {
+	fields, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		id, ip, endpoint, role, health string
+		port                           int
+	)
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, err := redis.String(fields[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "id":
+			id, err = redis.String(fields[i+1], nil)
+		case "ip":
+			ip, err = redis.String(fields[i+1], nil)
+		case "endpoint":
+			endpoint, err = redis.String(fields[i+1], nil)
+		case "port":
+			port, err = redis.Int(fields[i+1], nil)
+		case "role":
+			role, err = redis.String(fields[i+1], nil)
+		case "health":
+			health, err = redis.String(fields[i+1], nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("CLUSTER SHARDS: no port for node %s", id)
+	}
+	host := endpoint
+	if host == "" || host == "?" {
+		host = ip
+	}
+	node := b.node(id, b.addr(host, port))
+	node.Role = role
+	node.Failed = health != "" && health != "online"
+	return node, nil
+}
+
+// Parse the output of CLUSTER NODES, one node per line:
+//
+//	<id> <ip:port@cport[,hostname]> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ... <slot>
+//
+// where a slot is either a number, a range "start-end", or a slot being
+// migrated "[slot->-id]" or imported "[slot-<-id]".
+func ParseClusterNodes(text string, seed string) (*ClusterTopology, error) {
+	b := newTopologyBuilder(seed)
+	type replicaOf struct {
+		node     *ClusterNode
+		masterID string
+	}
+	var replicas []replicaOf
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("CLUSTER NODES: short line %q", line)
+		}
+		flags := strings.Split(fields[2], ",")
+		if hasFlag(flags, "noaddr") || hasFlag(flags, "handshake") {
+			continue
+		}
+		addr, err := b.nodesAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		node := b.node(fields[0], addr)
+		node.Flags = flags
+		node.Failed = hasFlag(flags, "fail") || fields[7] != "connected"
+
+		if hasFlag(flags, "master") {
+			b.addMaster(node)
+		} else if hasFlag(flags, "slave") || hasFlag(flags, "replica") {
+			node.Role = RoleReplica
+			node.MasterID = fields[3]
+			replicas = append(replicas, replicaOf{node, fields[3]})
+		}
+
+		for _, s := range fields[8:] {
+			if strings.HasPrefix(s, "[") {
+				if err := node.parseMigration(s); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			var start, end int64
+			if i := strings.IndexByte(s, '-'); i >= 0 {
+				start, err = strconv.ParseInt(s[:i], 10, 32)
+				if err == nil {
+					end, err = strconv.ParseInt(s[i+1:], 10, 32)
+				}
+			} else {
+				start, err = strconv.ParseInt(s, 10, 32)
+				end = start
+			}
+			if err != nil {
+				return nil, fmt.Errorf("CLUSTER NODES: invalid slot %q", s)
+			}
+			r, err := parseSlotRange(start, end)
+			if err != nil {
+				return nil, err
+			}
+			node.Slots = append(node.Slots, r)
+		}
+	}
+	for _, r := range replicas {
+		if master, ok := b.byKey[r.masterID]; ok && master.Role == RoleMaster {
+			b.addReplica(master, r.node)
+		}
+	}
+	return b.topology(), nil
+}
+
+// Parse "ip:port@cport,hostname". IPv6 addresses are not bracketed.
+func (b *topologyBuilder) nodesAddr(field string) (string, error) {
+	if i := strings.IndexByte(field, ','); i >= 0 {
+		field = field[:i]
+	}
+	if i := strings.IndexByte(field, '@'); i >= 0 {
+		field = field[:i]
+	}
+	i := strings.LastIndexByte(field, ':')
+	if i < 0 {
+		return "", fmt.Errorf("CLUSTER NODES: invalid address %q", field)
+	}
+	port, err := strconv.Atoi(field[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("CLUSTER NODES: invalid address %q", field)
+	}
+	if port == 0 {
+		// the node does not know its address yet, this is the seed
+		return b.seed, nil
+	}
+	return b.addr(field[:i], port), nil
+}
+
+// Parse "[slot->-id]" or "[slot-<-id]".
+func (node *ClusterNode) parseMigration(s string) error {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	var (
+		sep  string
+		dest *map[uint16]string
+	)
+	if strings.Contains(s, "->-") {
+		sep, dest = "->-", &node.Migrating
+	} else if strings.Contains(s, "-<-") {
+		sep, dest = "-<-", &node.Importing
+	} else {
+		return fmt.Errorf("CLUSTER NODES: invalid slot %q", s)
+	}
+	parts := strings.SplitN(s, sep, 2)
+	slot, err := strconv.Atoi(parts[0])
+	if err != nil || slot < 0 || slot >= RedisClusterHashSlots {
+		return fmt.Errorf("CLUSTER NODES: invalid slot %q", s)
+	}
+	if *dest == nil {
+		*dest = make(map[uint16]string)
+	}
+	(*dest)[uint16(slot)] = parts[1]
+	return nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package goredis
+
+import (
+	"reflect"
+	"testing"
+)
+
+// CLUSTER NODES of Redis 7, with cluster bus ports and hostnames
+const clusterNodesFixture = `07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004,hostname4 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002,hostname2 master - 0 1426238316232 2 connected 5461-10922
+292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:30003@31003,hostname3 master - 0 1426238318243 3 connected 10923-16383
+6ec23923021cf3ffec47632106199cb7f496ce01 127.0.0.1:30005@31005,hostname5 slave 67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 0 1426238316232 5 connected
+824fe116063bc5fcf9f4ffd895bc17aee7731ac3 127.0.0.1:30006@31006,hostname6 slave 292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 0 1426238317741 6 connected
+e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001,hostname1 myself,master - 0 0 1 connected 0-5460
+`
+
+// CLUSTER NODES of Redis 3 in the middle of a resharding, with single
+// slots and a node which does not know its own address
+const clusterNodesMigratingFixture = `3fc783611028b1707fd65345e763befb36454d73 10.0.0.2:7001 master - 0 1385503418521 0 connected 5461-10922 [5460-<-aaee4a3fcd1ba1d20bf5a8d2bd11dfb3bd5b4f79]
+aaee4a3fcd1ba1d20bf5a8d2bd11dfb3bd5b4f79 :0 myself,master - 0 0 1 connected 0-5459 5460 [5460->-3fc783611028b1707fd65345e763befb36454d73]
+d1861060fe6a534d42d8a19aeb36600e18785e04 10.0.0.3:7002 master - 0 1385503419023 2 connected 10923 10924-16383
+6cb4a1ff6b9dd4bd7a3c2bd1c4d6acd5d1dcb3f5 10.0.0.4:7003 slave,fail d1861060fe6a534d42d8a19aeb36600e18785e04 1385503410000 1385503409000 2 disconnected
+1a1b1c1d1e1f1a1b1c1d1e1f1a1b1c1d1e1f1a1b :0 handshake - 0 0 0 disconnected
+`
+
+// CLUSTER NODES with IPv6 addresses, which are not bracketed
+const clusterNodesIPv6Fixture = `e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca ::1:30001@31001 myself,master - 0 0 1 connected 0-16383
+07c37dfeb235213a872192d90877d0cd55635b91 fe80::1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+`
+
+func bulk(s string) []byte {
+	return []byte(s)
+}
+
+func TestParseClusterNodes(t *testing.T) {
+	topology, err := ParseClusterNodes(clusterNodesFixture, "127.0.0.1:30001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topology.Masters) != 3 {
+		t.Fatal("masters:", len(topology.Masters))
+	}
+	want := []struct {
+		id, addr string
+		slots    []SlotRange
+		replica  string
+	}{
+		{"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1", "127.0.0.1:30002", []SlotRange{{5461, 10922}}, "127.0.0.1:30005"},
+		{"292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f", "127.0.0.1:30003", []SlotRange{{10923, 16383}}, "127.0.0.1:30006"},
+		{"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca", "127.0.0.1:30001", []SlotRange{{0, 5460}}, "127.0.0.1:30004"},
+	}
+	for i, w := range want {
+		m := topology.Masters[i]
+		if m.ID != w.id || m.Addr != w.addr || m.Role != RoleMaster || !reflect.DeepEqual(m.Slots, w.slots) {
+			t.Errorf("master %d: %+v", i, m)
+		}
+		if len(m.Replicas) != 1 || m.Replicas[0].Addr != w.replica ||
+			m.Replicas[0].Role != RoleReplica || m.Replicas[0].MasterID != w.id {
+			t.Errorf("replicas of %s: %+v", w.addr, m.Replicas)
+		}
+	}
+	slots := topology.Slots()
+	if len(slots) != RedisClusterHashSlots || slots[0] != "127.0.0.1:30001" ||
+		slots[5461] != "127.0.0.1:30002" || slots[16383] != "127.0.0.1:30003" {
+		t.Error("slots:", len(slots), slots[0], slots[5461], slots[16383])
+	}
+	if addrs := topology.Addrs(); len(addrs) != 6 {
+		t.Error("addrs:", addrs)
+	}
+}
+
+func TestParseClusterNodesMigrating(t *testing.T) {
+	topology, err := ParseClusterNodes(clusterNodesMigratingFixture, "10.0.0.1:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topology.Masters) != 3 {
+		t.Fatal("masters:", len(topology.Masters))
+	}
+	importing, myself, last := topology.Masters[0], topology.Masters[1], topology.Masters[2]
+	if importing.Importing[5460] != myself.ID || len(importing.Migrating) != 0 {
+		t.Errorf("importing: %+v", importing)
+	}
+	if myself.Addr != "10.0.0.1:7000" || myself.Migrating[5460] != importing.ID {
+		t.Errorf("myself: %+v", myself)
+	}
+	if !reflect.DeepEqual(myself.Slots, []SlotRange{{0, 5459}, {5460, 5460}}) {
+		t.Error("slots:", myself.Slots)
+	}
+	if !reflect.DeepEqual(last.Slots, []SlotRange{{10923, 10923}, {10924, 16383}}) {
+		t.Error("slots:", last.Slots)
+	}
+	if len(last.Replicas) != 1 || !last.Replicas[0].Failed {
+		t.Errorf("replicas: %+v", last.Replicas)
+	}
+	if len(topology.Slots()) != RedisClusterHashSlots {
+		t.Error("slots:", len(topology.Slots()))
+	}
+}
+
+func TestParseClusterNodesIPv6(t *testing.T) {
+	topology, err := ParseClusterNodes(clusterNodesIPv6Fixture, "[::1]:30001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := topology.Addrs(); !reflect.DeepEqual(addrs, []string{"[::1]:30001", "[fe80::1]:30004"}) {
+		t.Error("addrs:", addrs)
+	}
+}
+
+func TestParseClusterNodesErrors(t *testing.T) {
+	for _, text := range []string{
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001 master",
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1 master - 0 0 1 connected 0-5460",
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001 master - 0 0 1 connected 0-x",
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001 master - 0 0 1 connected 100-16384",
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001 master - 0 0 1 connected [100]",
+	} {
+		if _, err := ParseClusterNodes(text, "127.0.0.1:30001"); err == nil {
+			t.Errorf("no error for %q", text)
+		}
+	}
+}
+
+func TestParseClusterSlots(t *testing.T) {
+	// Redis 7 reply with node metadata, and Redis 3.0 entries without
+	// node ids and with an empty host
+	reply := []interface{}{
+		[]interface{}{int64(0), int64(5460),
+			[]interface{}{bulk("127.0.0.1"), int64(30001), bulk("09dbe9720cda62f7865eabc5fd8857c5d2678366"),
+				[]interface{}{bulk("hostname"), bulk("host-1.redis.example.com")}},
+			[]interface{}{bulk("127.0.0.1"), int64(30004), bulk("821d8ca00d7ccf931ed3ffc7e3db0599d2271abf"),
+				[]interface{}{bulk("hostname"), bulk("host-2.redis.example.com")}},
+		},
+		[]interface{}{int64(5461), int64(10922),
+			[]interface{}{bulk("127.0.0.1"), int64(30002)},
+			[]interface{}{bulk("127.0.0.1"), int64(30005)},
+		},
+		[]interface{}{int64(10923), int64(16383),
+			[]interface{}{bulk(""), int64(30003)},
+		},
+		[]interface{}{int64(16380), int64(16380),
+			[]interface{}{bulk("127.0.0.1"), int64(30001), bulk("09dbe9720cda62f7865eabc5fd8857c5d2678366")},
+		},
+	}
+	topology, err := ParseClusterSlots(reply, "127.0.0.1:30003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topology.Masters) != 3 {
+		t.Fatal("masters:", len(topology.Masters))
+	}
+	first := topology.Masters[0]
+	if first.ID != "09dbe9720cda62f7865eabc5fd8857c5d2678366" || first.Addr != "127.0.0.1:30001" ||
+		!reflect.DeepEqual(first.Slots, []SlotRange{{0, 5460}, {16380, 16380}}) {
+		t.Errorf("first: %+v", first)
+	}
+	if len(first.Replicas) != 1 || first.Replicas[0].Addr != "127.0.0.1:30004" ||
+		first.Replicas[0].MasterID != first.ID {
+		t.Errorf("replicas: %+v", first.Replicas)
+	}
+	if second := topology.Masters[1]; second.Addr != "127.0.0.1:30002" || len(second.Replicas) != 1 {
+		t.Errorf("second: %+v", second)
+	}
+	if third := topology.Masters[2]; third.Addr != "127.0.0.1:30003" {
+		t.Errorf("third: %+v", third)
+	}
+
+	for _, bad := range []interface{}{
+		bulk("ERR"),
+		[]interface{}{[]interface{}{int64(0), int64(5460)}},
+		[]interface{}{[]interface{}{int64(5460), int64(0), []interface{}{bulk("127.0.0.1"), int64(30001)}}},
+		[]interface{}{[]interface{}{int64(0), int64(5460), []interface{}{bulk("127.0.0.1")}}},
+	} {
+		if _, err := ParseClusterSlots(bad, "127.0.0.1:30001"); err == nil {
+			t.Errorf("no error for %v", bad)
+		}
+	}
+}
+
+func TestParseClusterShards(t *testing.T) {
+	node := func(id string, port int64, role, health string) interface{} {
+		return []interface{}{
+			bulk("id"), bulk(id), bulk("port"), port, bulk("ip"), bulk("127.0.0.1"),
+			bulk("endpoint"), bulk("127.0.0.1"), bulk("hostname"), bulk(""),
+			bulk("role"), bulk(role), bulk("replication-offset"), int64(72156),
+			bulk("health"), bulk(health),
+		}
+	}
+	reply := []interface{}{
+		[]interface{}{
+			bulk("slots"), []interface{}{int64(0), int64(5460), int64(16380), int64(16383)},
+			bulk("nodes"), []interface{}{
+				node("e10b7051d6bf2d5febd39a2be297bbaea6084111", 30004, "replica", "online"),
+				node("d2dee846c6f7ac8d5ffa6df1b4bb6b4b1bb8e3a8", 30001, "master", "online"),
+			},
+		},
+		[]interface{}{
+			bulk("slots"), []interface{}{int64(5461), int64(16379)},
+			bulk("nodes"), []interface{}{
+				node("6dfed0b1e2e6ba2dd5e4e4ba0bcb8f9f2ec3e1f5", 30002, "master", "online"),
+				node("1f38bd5d5f66d5bc1bd5b1ea98bb0b1c8f1c0e55", 30005, "replica", "loading"),
+			},
+		},
+		// a shard without slots yet
+		[]interface{}{
+			bulk("slots"), []interface{}{},
+			bulk("nodes"), []interface{}{
+				node("7b3e3c1c5c11e1a7e7f9d1e55f6b4d4a1c3a7e11", 30003, "master", "online"),
+			},
+		},
+	}
+	topology, err := ParseClusterShards(reply, "127.0.0.1:30001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topology.Masters) != 3 {
+		t.Fatal("masters:", len(topology.Masters))
+	}
+	first, second := topology.Masters[0], topology.Masters[1]
+	if first.Addr != "127.0.0.1:30001" || !reflect.DeepEqual(first.Slots, []SlotRange{{0, 5460}, {16380, 16383}}) ||
+		len(first.Replicas) != 1 || first.Replicas[0].Addr != "127.0.0.1:30004" {
+		t.Errorf("first: %+v", first)
+	}
+	if second.Addr != "127.0.0.1:30002" || len(second.Replicas) != 1 || !second.Replicas[0].Failed {
+		t.Errorf("second: %+v", second)
+	}
+	if len(topology.Slots()) != 5461+4+10919 {
+		t.Error("slots:", len(topology.Slots()))
+	}
+}
+
+func TestClusterTopologyDiscovery(t *testing.T) {
+	for _, disabled := range [][]string{
+		nil,
+		{"CLUSTER SLOTS"},
+		{"CLUSTER SLOTS", "CLUSTER SHARDS"},
+	} {
+		fc := newFakeCluster(3)
+		fc.disable(disabled...)
+		fc.setBusPort(true)
+		fc.move(100, 100, 2)
+		cluster := NewRedisCluster(fc.addrs()[:1], 8, 8, false)
+		topology := cluster.Topology()
+		if len(topology.Masters) != 3 {
+			t.Fatal(disabled, "masters:", len(topology.Masters))
+		}
+		if addr := cluster.HandleForKey("{a}").Addr; addr != fc.nodes[fc.ownerOf(HashSlot("a"))].addr {
+			t.Error(disabled, "wrong node", addr)
+		}
+		if addr := cluster.RedisHandleForSlot(100).Addr; addr != fc.nodes[2].addr {
+			t.Error(disabled, "wrong node for single slot", addr)
+		}
+		if _, err := cluster.Do("SET", "foo", "bar"); err != nil {
+			t.Error(disabled, err)
+		}
+		cluster.Close()
+		fc.Close()
+	}
+}
@@ -0,0 +1,205 @@
+package goredis
+
+import (
+	"errors"
+	"strings"
+)
+
+// Number of times Watch runs a transaction whose watched keys changed.
+const TxMaxRetries = 16
+
+var (
+	// EXEC returned nil, a watched key changed.
+	ErrWatchFailed = errors.New("transaction failed, a watched key changed")
+	// EXEC was refused because a command failed to queue, the replies
+	// returned with it hold the error.
+	ErrExecAbort = errors.New("transaction discarded because of previous errors")
+)
+
+// Tx is a MULTI/EXEC transaction on one connection, which is pinned from
+// the first WATCH until Exec or Close. The commands are queued locally and
+// sent with Exec. A Tx is not safe for concurrent use.
+//
+// On a cluster all the keys must hash to the same slot, the transaction
+// runs on the node serving it.
+type Tx struct {
+	pool     *Pool
+	cluster  *RedisCluster
+	sentinel *SentinelHandle
+	conn     *RedisConn
+	key      string // first key, routes the cluster transactions
+	watching bool
+	commands Commands
+}
+
+// Start a transaction on a connection of the pool.
+func (this *Pool) Tx() *Tx {
+	return &Tx{pool: this}
+}
+
+// Start a transaction on the node serving its keys.
+func (self *RedisCluster) Tx() *Tx {
+	return &Tx{cluster: self}
+}
+
+// Start a transaction on the current master.
+func (this *SentinelHandle) Tx() *Tx {
+	return &Tx{sentinel: this}
+}
+
+// Check that the keys are in the slot of the transaction.
+func (this *Tx) checkKeys(keys []string) error {
+	if this.cluster == nil || this.cluster.loadTable().single {
+		return nil
+	}
+	for _, key := range keys {
+		if this.key == "" {
+			this.key = key
+		} else if HashSlot(key) != HashSlot(this.key) {
+			return ErrCrossSlot
+		}
+	}
+	return nil
+}
+
+// Return the pinned connection, getting one if needed.
+func (this *Tx) connection() *RedisConn {
+	if this.conn != nil {
+		return this.conn
+	}
+	if this.pool != nil {
+		this.conn = this.pool.Get()
+	} else if this.sentinel != nil {
+		this.conn = this.sentinel.Get()
+	} else if this.key != "" {
+		this.conn = this.cluster.HandleForKey(this.key).Get()
+	} else if handle := this.cluster.RandomRedisHandle(); handle != nil {
+		this.conn = handle.Get()
+	} else {
+		this.conn = &RedisConn{err: ErrNoHandle}
+	}
+	return this.conn
+}
+
+// WATCH the keys, Exec fails with ErrWatchFailed if any of them changes
+// before.
+func (this *Tx) Watch(keys ...string) error {
+	if err := this.checkKeys(keys); err != nil {
+		return err
+	}
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	if _, err := this.connection().Do("WATCH", args...); err != nil {
+		return err
+	}
+	this.watching = true
+	return nil
+}
+
+func (this *Tx) Unwatch() error {
+	if this.conn == nil {
+		return nil
+	}
+	_, err := this.conn.Do("UNWATCH")
+	this.watching = false
+	return err
+}
+
+// Run the command at once on the pinned connection, to read the watched
+// keys.
+func (this *Tx) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := this.checkKeys(KeysForCommand(cmd, args...)); err != nil {
+		return nil, err
+	}
+	return this.connection().Do(cmd, args...)
+}
+
+// Queue the command, it is sent with Exec.
+func (this *Tx) Send(cmd string, args ...interface{}) error {
+	if err := this.checkKeys(KeysForCommand(cmd, args...)); err != nil {
+		return err
+	}
+	this.commands = append(this.commands, NewCommand(cmd, args...))
+	return nil
+}
+
+// Run the queued commands in MULTI/EXEC and return their replies, then
+// release the connection. When EXEC is refused with EXECABORT, the
+// replies of the commands to MULTI are returned with ErrExecAbort.
+func (this *Tx) Exec() ([]*RedisReply, error) {
+	defer this.Close()
+	commands := make(Commands, 0, len(this.commands)+2)
+	commands = append(commands, NewCommand("MULTI"))
+	commands = append(commands, this.commands...)
+	commands = append(commands, NewCommand("EXEC"))
+	replies, err := this.connection().DoMulti(commands)
+	if err != nil {
+		return nil, err
+	}
+	// EXEC drops the watches, whatever its result
+	this.watching = false
+	exec := replies[len(replies)-1]
+	switch exec.Type {
+	case REDIS_REPLY_ERROR:
+		if strings.HasPrefix(exec.Str, "EXECABORT") {
+			return replies[1 : len(replies)-1], ErrExecAbort
+		}
+		return nil, errors.New(exec.Str)
+	case REDIS_REPLY_NIL:
+		return nil, ErrWatchFailed
+	}
+	return exec.Element, nil
+}
+
+// Release the connection without running the transaction.
+func (this *Tx) Close() error {
+	if this.conn == nil {
+		return nil
+	}
+	if this.watching {
+		this.Unwatch()
+	}
+	err := this.conn.Close()
+	this.conn = nil
+	this.commands = nil
+	return err
+}
+
+// Run fn in a transaction watching the keys, and retry it while the keys
+// change under it, at most TxMaxRetries times. fn reads the keys with
+// tx.Do and queues the commands with tx.Send, Watch runs Exec.
+func (this *Pool) Watch(fn func(tx *Tx) error, keys ...string) ([]*RedisReply, error) {
+	return runTx(this.Tx, fn, keys)
+}
+
+// Same as Pool.Watch, on the node serving the keys.
+func (self *RedisCluster) Watch(fn func(tx *Tx) error, keys ...string) ([]*RedisReply, error) {
+	return runTx(self.Tx, fn, keys)
+}
+
+// Same as Pool.Watch, on the current master.
+func (this *SentinelHandle) Watch(fn func(tx *Tx) error, keys ...string) ([]*RedisReply, error) {
+	return runTx(this.Tx, fn, keys)
+}
+
+func runTx(begin func() *Tx, fn func(tx *Tx) error, keys []string) ([]*RedisReply, error) {
+	for i := 0; ; i++ {
+		tx := begin()
+		if len(keys) > 0 {
+			if err := tx.Watch(keys...); err != nil {
+				tx.Close()
+				return nil, err
+			}
+		}
+		if err := fn(tx); err != nil {
+			tx.Close()
+			return nil, err
+		}
+		replies, err := tx.Exec()
+		if err != ErrWatchFailed || i+1 >= TxMaxRetries {
+			return replies, err
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package goredis
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func newFakePool() (*fakeServer, *Pool) {
+	store := newFakeStore()
+	server := newFakeServer(func(c *fakeConn, args []string) interface{} {
+		return store.doConn(c, args)
+	})
+	pool := NewPool(func() (redis.Conn, error) {
+		return redis.Dial("tcp", server.addr)
+	}, 4, 4)
+	return server, pool
+}
+
+func TestPoolTx(t *testing.T) {
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+
+	tx := pool.Tx()
+	tx.Send("SET", "foo", "bar")
+	tx.Send("INCR", "n")
+	tx.Send("GET", "foo")
+	replies, err := tx.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 3 || replies[0].Str != "OK" || replies[1].Integer != 1 || replies[2].Str != "bar" {
+		t.Fatalf("replies: %+v", replies)
+	}
+
+	// a watched key changes before EXEC
+	tx = pool.Tx()
+	if err := tx.Watch("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Do("SET", "foo", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Send("SET", "foo", "tx")
+	if _, err := tx.Exec(); err != ErrWatchFailed {
+		t.Fatal("watch:", err)
+	}
+	if v, _ := redis.String(pool.Do("GET", "foo")); v != "changed" {
+		t.Error("foo:", v)
+	}
+
+	// a command fails to queue
+	tx = pool.Tx()
+	tx.Send("SET", "foo", "tx")
+	tx.Send("NOSUCHCOMMAND")
+	replies, err = tx.Exec()
+	if err != ErrExecAbort {
+		t.Fatal("abort:", err)
+	}
+	if len(replies) != 2 || replies[0].Str != "QUEUED" || replies[1].Type != REDIS_REPLY_ERROR {
+		t.Errorf("replies: %+v", replies)
+	}
+
+	// the connections went back to the pool, without watches
+	if n := pool.curActive; n != 2 {
+		t.Error("curActive:", n)
+	}
+}
+
+func TestPoolWatchRetry(t *testing.T) {
+	server, pool := newFakePool()
+	defer server.Close()
+	defer pool.Close()
+
+	runs := 0
+	replies, err := pool.Watch(func(tx *Tx) error {
+		runs++
+		n, err := redis.Int(tx.Do("GET", "n"))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		if runs == 1 {
+			// somebody else wins the race
+			pool.Do("SET", "n", "10")
+		}
+		return tx.Send("SET", "n", strconv.Itoa(n+1))
+	}, "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs != 2 || len(replies) != 1 {
+		t.Error("runs:", runs, "replies:", len(replies))
+	}
+	if n, _ := redis.Int(pool.Do("GET", "n")); n != 11 {
+		t.Error("n:", n)
+	}
+}
+
+func TestClusterTx(t *testing.T) {
+	fc := newFakeCluster(3)
+	defer fc.Close()
+	cluster := NewRedisCluster(fc.addrs(), 8, 8, false)
+	defer cluster.Close()
+
+	tx := cluster.Tx()
+	if err := tx.Send("SET", "{user1}.name", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Send("SET", "{user2}.name", "y"); err != ErrCrossSlot {
+		t.Fatal("cross slot:", err)
+	}
+	tx.Close()
+
+	replies, err := cluster.Watch(func(tx *Tx) error {
+		tx.Send("SET", "{user1}.name", "x")
+		return tx.Send("INCR", "{user1}.visits")
+	}, "{user1}.name", "{user1}.visits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || replies[1].Integer != 1 {
+		t.Fatalf("replies: %+v", replies)
+	}
+	owner := fc.ownerOf(HashSlot("user1"))
+	if fc.nodes[owner].count("EXEC") != 1 || fc.count("EXEC") != 1 {
+		t.Error("transaction not run on the owner of the slot")
+	}
+}
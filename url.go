@@ -0,0 +1,298 @@
+package goredis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The pool sizes of the clients created from a URL without max_idle or
+// max_active.
+const (
+	DefaultMaxIdle   = 8
+	DefaultMaxActive = 64
+)
+
+// ParseURL could not parse the URL, its errors wrap this one.
+var ErrInvalidURL = errors.New("invalid redis URL")
+
+// The settings of a client, as given by a URL to ParseURL.
+type ClientOptions struct {
+	// host:port of the server, the cluster seeds or the sentinels, or the
+	// path of a unix socket
+	Addrs []string
+	// a RedisCluster, even with one seed
+	Cluster bool
+	// a SentinelHandle of this master, Addrs being the sentinels
+	MasterName string
+
+	MaxIdle   int
+	MaxActive int
+	Debug     bool
+	// of a cluster
+	ReadPreference ReadPreference
+
+	Dial DialOptions
+	// the connections to the sentinels, with the timeouts and TLS of Dial
+	// but their own credentials
+	SentinelDial DialOptions
+}
+
+var readPreferences = map[string]ReadPreference{
+	"master":         ReadMaster,
+	"prefer_replica": ReadPreferReplica,
+	"replica_only":   ReadReplicaOnly,
+	"nearest":        ReadNearest,
+	"random":         ReadRandom,
+}
+
+// The parameters of the sentinel URLs only.
+var sentinelParams = map[string]bool{
+	"master_name": true, "sentinel_username": true, "sentinel_password": true,
+}
+
+// Parse a URL of the forms
+//
+//	redis://[[user]:password@]host[:port][/db][?params]
+//	rediss://...                                  the same with TLS
+//	unix://[[user]:password@]/path/to/socket[?params]
+//	redis://host1:port1,host2:port2,...[?params]  a cluster
+//	redis+cluster://host:port[?params]            a cluster, even with one seed
+//	redis+sentinel://host1:port1,...[/master[/db]][?params]
+//
+// The ports are 6379 by default, 26379 for the sentinels. The params are
+// db, max_idle, max_active, debug, client_name, read_preference (master,
+// prefer_replica, replica_only, nearest or random), connect_timeout,
+// read_timeout, write_timeout and keep_alive (seconds or a duration such
+// as 500ms), and for TLS ca_file, cert_file, key_file, server_name and
+// skip_verify. A sentinel URL takes master_name, sentinel_username and
+// sentinel_password. More hosts are given with addr.
+func ParseURL(rawurl string) (*ClientOptions, error) {
+	i := strings.Index(rawurl, "://")
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no scheme in %q", ErrInvalidURL, rawurl)
+	}
+	scheme, rest := rawurl[:i], rawurl[i+3:]
+	kind := ""
+	if j := strings.IndexByte(scheme, '+'); j >= 0 {
+		scheme, kind = scheme[:j], scheme[j+1:]
+	}
+	options := &ClientOptions{MaxIdle: DefaultMaxIdle, MaxActive: DefaultMaxActive}
+	switch kind {
+	case "":
+	case "cluster":
+		options.Cluster = true
+	case "sentinel":
+	default:
+		return nil, fmt.Errorf("%w: unknown scheme %s+%s", ErrInvalidURL, scheme, kind)
+	}
+	defaultPort := "6379"
+	if kind == "sentinel" {
+		defaultPort = "26379"
+	}
+
+	var (
+		u   *url.URL
+		err error
+	)
+	switch scheme {
+	case "redis", "rediss":
+		// the hosts are split by hand, url.Parse takes one only
+		end := strings.IndexAny(rest, "/?#")
+		if end < 0 {
+			end = len(rest)
+		}
+		authority := rest[:end]
+		userinfo := ""
+		if at := strings.LastIndexByte(authority, '@'); at >= 0 {
+			userinfo, authority = authority[:at+1], authority[at+1:]
+		}
+		for _, host := range strings.Split(authority, ",") {
+			if host != "" {
+				options.Addrs = append(options.Addrs, host)
+			}
+		}
+		u, err = url.Parse(scheme + "://" + userinfo + "localhost" + rest[end:])
+	case "unix":
+		if kind != "" {
+			return nil, fmt.Errorf("%w: unix+%s", ErrInvalidURL, kind)
+		}
+		u, err = url.Parse(rawurl)
+		if err == nil {
+			options.Dial.Network = "unix"
+			options.Addrs = []string{u.Path}
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown scheme %s", ErrInvalidURL, scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	if u.User != nil {
+		options.Dial.Username = u.User.Username()
+		options.Dial.Password, _ = u.User.Password()
+	}
+
+	// the path is the database, after the name of the master for the
+	// sentinels
+	if scheme != "unix" {
+		path := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if kind == "sentinel" && path[0] != "" {
+			options.MasterName, path = path[0], path[1:]
+		}
+		if len(path) > 1 {
+			return nil, fmt.Errorf("%w: path %s", ErrInvalidURL, u.Path)
+		}
+		if len(path) == 1 && path[0] != "" {
+			if options.Dial.Database, err = strconv.Atoi(path[0]); err != nil {
+				return nil, fmt.Errorf("%w: database %s", ErrInvalidURL, path[0])
+			}
+		}
+	}
+
+	var caFile, certFile, keyFile, serverName string
+	var skipVerify, withTLS bool
+	sentinelDial := DialOptions{}
+	for name, values := range u.Query() {
+		value := values[len(values)-1]
+		if sentinelParams[name] && kind != "sentinel" {
+			return nil, fmt.Errorf("%w: %s without redis+sentinel://", ErrInvalidURL, name)
+		}
+		switch name {
+		case "addr":
+			options.Addrs = append(options.Addrs, values...)
+			continue
+		case "db":
+			options.Dial.Database, err = strconv.Atoi(value)
+		case "max_idle":
+			options.MaxIdle, err = strconv.Atoi(value)
+		case "max_active":
+			options.MaxActive, err = strconv.Atoi(value)
+		case "debug":
+			options.Debug, err = strconv.ParseBool(value)
+		case "client_name":
+			options.Dial.ClientName = value
+		case "read_preference":
+			pref, ok := readPreferences[value]
+			if !ok {
+				err = errors.New("unknown read preference")
+			}
+			options.ReadPreference = pref
+		case "connect_timeout", "dial_timeout":
+			options.Dial.ConnectTimeout, err = parseURLDuration(value)
+		case "read_timeout":
+			options.Dial.ReadTimeout, err = parseURLDuration(value)
+		case "write_timeout":
+			options.Dial.WriteTimeout, err = parseURLDuration(value)
+		case "keep_alive":
+			options.Dial.KeepAlive, err = parseURLDuration(value)
+		case "ca_file":
+			caFile, withTLS = value, true
+		case "cert_file":
+			certFile, withTLS = value, true
+		case "key_file":
+			keyFile, withTLS = value, true
+		case "server_name":
+			serverName, withTLS = value, true
+		case "skip_verify":
+			withTLS = true
+			skipVerify, err = strconv.ParseBool(value)
+		case "master_name":
+			options.MasterName = value
+		case "sentinel_username":
+			sentinelDial.Username = value
+		case "sentinel_password":
+			sentinelDial.Password = value
+		default:
+			return nil, fmt.Errorf("%w: unknown parameter %s", ErrInvalidURL, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s=%s: %v", ErrInvalidURL, name, value, err)
+		}
+	}
+
+	if len(options.Addrs) == 0 {
+		return nil, fmt.Errorf("%w: no host", ErrInvalidURL)
+	}
+	if scheme != "unix" {
+		for i, addr := range options.Addrs {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					return nil, fmt.Errorf("%w: host %s", ErrInvalidURL, options.Addrs[i])
+				}
+			}
+			options.Addrs[i] = addr
+		}
+	}
+	if kind == "sentinel" {
+		if options.MasterName == "" {
+			return nil, fmt.Errorf("%w: no master name", ErrInvalidURL)
+		}
+	} else if len(options.Addrs) > 1 {
+		options.Cluster = true
+	}
+
+	if withTLS && scheme != "rediss" {
+		return nil, fmt.Errorf("%w: TLS parameters with %s://", ErrInvalidURL, scheme)
+	}
+	if scheme == "rediss" {
+		config, err := NewTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = serverName
+		config.InsecureSkipVerify = skipVerify
+		options.Dial.TLSConfig = config
+	}
+	if kind == "sentinel" {
+		sentinelDial.Network = options.Dial.Network
+		sentinelDial.ConnectTimeout = options.Dial.ConnectTimeout
+		sentinelDial.ReadTimeout = options.Dial.ReadTimeout
+		sentinelDial.WriteTimeout = options.Dial.WriteTimeout
+		sentinelDial.KeepAlive = options.Dial.KeepAlive
+		sentinelDial.TLSConfig = options.Dial.TLSConfig
+		options.SentinelDial = sentinelDial
+	}
+	return options, nil
+}
+
+// Seconds, or a duration such as 500ms.
+func parseURLDuration(value string) (time.Duration, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Create the client of the options: a SentinelHandle when MasterName is
+// set, a RedisCluster for a cluster, a RedisHandle otherwise. As with
+// DialCluster and DialSentinel, the client is returned with the error.
+func NewClient(options *ClientOptions) (Client, error) {
+	if options.MasterName != "" {
+		return DialSentinelWithOptions(options.MasterName, options.Addrs, options.MaxIdle, options.MaxActive,
+			options.Debug, options.Dial, options.SentinelDial)
+	}
+	if options.Cluster {
+		cluster, err := DialClusterWithOptions(options.Addrs, options.MaxIdle, options.MaxActive,
+			options.Debug, options.Dial)
+		if options.ReadPreference != ReadMaster {
+			cluster.SetReadPreference(options.ReadPreference)
+		}
+		return cluster, err
+	}
+	return NewRedisHandleWithOptions(options.Addrs[0], options.MaxIdle, options.MaxActive, options.Debug, options.Dial), nil
+}
+
+// Parse the URL and create its client, see ParseURL and NewClient.
+func DialURL(rawurl string) (Client, error) {
+	options, err := ParseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(options)
+}